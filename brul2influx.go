@@ -1,355 +1,208 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net"
+	"context"
+	"flag"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
 	"sync"
-	"time"
+	"syscall"
 
-	"github.com/influxdata/influxdb/client/v2"
+	"github.com/adamjacobmuller/brul2influx/influxbg"
 	log "github.com/sirupsen/logrus"
-	"gitlab.adam.gs/home/lib/influxbg"
 )
 
-type EnergySample struct {
-	WattHours float64
-	Watts     float64
-	Amps      float64
-}
-
-type PulseSample struct {
-	Pulses int64
-}
-
-type TemperatureSample struct {
-	Temperature float64
-}
-
-type Config struct {
-	Hosts    []string `json:"hosts"`
-	InfluxDB string   `json:"influxdb"`
-}
-
 func main() {
-	fh, err := os.Open("/config/config.json")
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error":  err,
-			"config": "/config/config.json",
-		}).Panic("unable to open configuration file")
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:], os.Stdout, os.Stderr))
 	}
 
-	data, err := io.ReadAll(fh)
+	options, err := parseOptions(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
-			"error":  err,
-			"config": "/config/config.json",
-		}).Panic("unable to read configuration file")
+			"error": err,
+		}).Fatal("invalid arguments")
 	}
+	log.SetLevel(options.logLevel)
 
-	config := &Config{}
-	err = json.Unmarshal(data, config)
+	data, err := os.ReadFile(options.config)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error":  err,
-			"config": "/config/config.json",
-			"data":   string(data),
-		}).Panic("unable to unmarshal configuration file")
+			"config": options.config,
+		}).Fatal("unable to read configuration file")
 	}
 
-	ibgw, err := influxbg.NewInfluxBGWriter(client.HTTPConfig{
-		Addr: config.InfluxDB,
-	}, "gem")
+	config, virtual, err := prepareConfig(data, options)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"error":   err,
-			"address": config.InfluxDB,
-		}).Panic("unable to create new NewInfluxBGWriter")
+			"error":  err,
+			"config": options.config,
+		}).Fatal("invalid configuration file")
+	}
+	packetConfigs.set(config.Devices, virtual)
+
+	var writers multiWriter
+
+	var ibgw *influxbg.InfluxBGWriter
+	if config.InfluxDB.Address != "" {
+		ibgw, err = config.InfluxDB.newWriter(config.Spool)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"address": config.InfluxDB.Address,
+			}).Panic("unable to create new NewInfluxBGWriter")
+		}
+		writers = append(writers, ibgw)
 	}
 
-	wg := &sync.WaitGroup{}
+	self := &selfMetrics{sources: sources, writer: ibgw}
 
-	wg.Add(len(config.Hosts))
+	var exporter *PrometheusExporter
+	if config.Prometheus != nil {
+		exporter = NewPrometheusExporter(config.Prometheus, self)
+		writers = append(writers, exporter)
+	}
 
-	for _, gemHost := range config.Hosts {
-		go func(gemHost string, ibgw *influxbg.InfluxBGWriter, wg *sync.WaitGroup) {
-			for {
-				conn, err := net.Dial("tcp", gemHost)
-				if err != nil {
-					log.Fatal("failed connecting")
-				}
+	var publisher *MQTTPublisher
+	if config.MQTT != nil {
+		publisher = NewMQTTPublisher(config.MQTT)
+		writers = append(writers, publisher)
+	}
 
-				go func() {
-					for range time.Tick(time.Second) {
-						conn.Write([]byte("^^^APISPK"))
-					}
-				}()
+	var elector *LeaderElector
+	if config.LeaderElection != nil {
+		elector, err = NewLeaderElector(config.LeaderElection)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("unable to set up leader election")
+		}
+	}
 
-				scanner := bufio.NewScanner(conn)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-				for scanner.Scan() {
-					var volts float64
-					var serial string
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
-					energy_channels := make(map[int64]*EnergySample)
-					pulse_channels := make(map[int64]*PulseSample)
-					temperature_channels := make(map[int64]*TemperatureSample)
+	go func() {
+		<-ctx.Done()
+		log.Info("received signal, shutting down")
+	}()
 
-					dataTrim := scanner.Text()
-					pairs := strings.Split(dataTrim, "&")
-					for _, dataPoint := range pairs {
-						dataPointSplit := strings.Split(dataPoint, "=")
-						if len(dataPointSplit) != 2 {
-							log.WithFields(log.Fields{
-								"dataPointSplit": dataPointSplit,
-								"dataPoint":      dataPoint,
-								"dataTrim":       dataTrim,
-								"gemHost":        gemHost,
-							}).Error("len(dataPointSplit) != 2")
-							continue
-						}
-						dataPointKey := dataPointSplit[0]
-						dataPointValue := dataPointSplit[1]
-						if dataPointKey == "Alive n" {
-							dataPointKey = "n"
-						}
+	wg := &sync.WaitGroup{}
 
-						switch dataPointKey {
-						case "v":
-							volts, err = strconv.ParseFloat(dataPointValue, 64)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"dataPoint":      dataPoint,
-									"dataPointValue": dataPointValue,
-									"dataTrim":       dataTrim,
-									"gemHost":        gemHost,
-								}).Error("unable to parseint for dataPointChannel")
-								continue
-							}
-						case "n":
-							serial = dataPointValue
-						case "m":
-							continue
-						default:
-							dataPointKeySplit := strings.Split(dataPointKey, "_")
-							if len(dataPointKeySplit) != 2 {
-								log.WithFields(log.Fields{
-									"dataPointKeySplit":      dataPointKeySplit,
-									"dataPointSplit":         dataPointSplit,
-									"dataPointKey":           dataPointKey,
-									"dataPoint":              dataPoint,
-									"dataTrim":               dataTrim,
-									"gemHost":                gemHost,
-									"len(dataPointKeySplit)": len(dataPointKeySplit),
-								}).Error("len(dataPointKeySplit) != 2")
-								continue
-							}
-							dataPointType := dataPointKeySplit[0]
-							dataPointChannel := dataPointKeySplit[1]
-							channel, err := strconv.ParseInt(dataPointChannel, 10, 64)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"dataPoint":        dataPoint,
-									"dataPointKey":     dataPointSplit,
-									"dataPointType":    dataPointType,
-									"dataPointChannel": dataPointChannel,
-									"dataTrim":         dataTrim,
-									"gemHost":          gemHost,
-								}).Error("unable to parseint for dataPointChannel")
-								continue
-							}
-							switch dataPointType {
-							case "wh":
-								val, err := strconv.ParseFloat(dataPointValue, 64)
-								if err != nil {
-									log.WithFields(log.Fields{
-										"dataPoint":        dataPoint,
-										"dataPointKey":     dataPointSplit,
-										"dataPointType":    dataPointType,
-										"dataPointValue":   dataPointValue,
-										"dataPointChannel": dataPointChannel,
-										"dataTrim":         dataTrim,
-										"gemHost":          gemHost,
-									}).Error("unable to parseint for dataPointValue")
-									continue
-								}
-								_, ok := energy_channels[channel]
-								if !ok {
-									energy_channels[channel] = &EnergySample{}
-								}
-								energy_channels[channel].WattHours = val
-							case "p":
-								val, err := strconv.ParseFloat(dataPointValue, 64)
-								if err != nil {
-									log.WithFields(log.Fields{
-										"dataPoint":        dataPoint,
-										"dataPointKey":     dataPointSplit,
-										"dataPointType":    dataPointType,
-										"dataPointValue":   dataPointValue,
-										"dataPointChannel": dataPointChannel,
-										"dataTrim":         dataTrim,
-										"gemHost":          gemHost,
-									}).Error("unable to parseint for dataPointValue")
-									continue
-								}
-								_, ok := energy_channels[channel]
-								if !ok {
-									energy_channels[channel] = &EnergySample{}
-								}
-								energy_channels[channel].Watts = val
-							case "a":
-								val, err := strconv.ParseFloat(dataPointValue, 64)
-								if err != nil {
-									log.WithFields(log.Fields{
-										"dataPoint":        dataPoint,
-										"dataPointKey":     dataPointSplit,
-										"dataPointType":    dataPointType,
-										"dataPointValue":   dataPointValue,
-										"dataPointChannel": dataPointChannel,
-										"dataTrim":         dataTrim,
-										"gemHost":          gemHost,
-									}).Error("unable to parseint for dataPointValue")
-									continue
-								}
-								_, ok := energy_channels[channel]
-								if !ok {
-									energy_channels[channel] = &EnergySample{}
-								}
-								energy_channels[channel].Amps = val
-							case "t":
-								if dataPointValue == "nc" {
-									continue
-								}
-								if dataPointValue == "x" {
-									continue
-								}
-								val, err := strconv.ParseFloat(dataPointValue, 64)
-								if err != nil {
-									log.WithFields(log.Fields{
-										"dataPoint":        dataPoint,
-										"dataPointKey":     dataPointSplit,
-										"dataPointChannel": dataPointChannel,
-										"dataTrim":         dataTrim,
-										"gemHost":          gemHost,
-									}).Error("unable to parseint for dataPointValue")
-									continue
-								}
-								temperature_channels[channel] = &TemperatureSample{Temperature: val}
-							case "c":
-								val, err := strconv.ParseInt(dataPointValue, 10, 64)
-								if err != nil {
-									log.WithFields(log.Fields{
-										"dataPoint":        dataPoint,
-										"dataPointKey":     dataPointSplit,
-										"dataPointChannel": dataPointChannel,
-										"dataTrim":         dataTrim,
-										"gemHost":          gemHost,
-									}).Error("unable to parseint for dataPointValue")
-									continue
-								}
-								pulse_channels[channel] = &PulseSample{Pulses: val}
-							}
-						}
-					}
+	// creating the database retries until InfluxDB is reachable, so it
+	// must not hold up collecting, listening or spooling; the writer keeps
+	// points refused with database not found until it exists
+	if ibgw != nil && config.InfluxDB.CreateDatabase {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := config.InfluxDB.ensureDatabase(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"address": config.InfluxDB.Address,
+				}).Error("gave up creating influxdb database")
+			}
+		}()
+	}
 
-					log.WithFields(log.Fields{
-						"dataTrim": dataTrim,
-						"serial":   serial,
-						"volts":    volts,
-					}).Info("decoded voltage data")
+	if exporter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := exporter.Serve(ctx, config.Prometheus)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"address": config.Prometheus.Address,
+				}).Error("prometheus server failed")
+			}
+		}()
+	}
 
-					ts := time.Now()
+	collectors := newCollectorSet(writers)
+	collectors.update(config.Hosts)
 
-					voltage_tags := map[string]string{
-						"serial": serial,
-					}
-					voltage_fields := map[string]interface{}{
-						"volts": volts,
-					}
+	// the tasks run on the leader only when leader election is
+	// configured, so that replicas do not write points twice
+	tasks, err := newLeaderTasks(config, collectors, writers, publisher, self)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Panic("unable to create listener")
+	}
 
-					err := ibgw.Write("voltage", voltage_tags, voltage_fields, ts)
-					if err != nil {
-						log.WithFields(log.Fields{
-							"error":   err,
-							"tags":    voltage_tags,
-							"fields":  voltage_fields,
-							"gemHost": gemHost,
-						}).Error("unable to write point for voltage")
-					}
+	if elector != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			elector.Run(ctx, tasks.Run)
+		}()
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tasks.Run(ctx)
+		}()
+	}
 
-					for channel, value := range energy_channels {
-						//fmt.Printf("Energy %d = %#v\n", channel, value)
-						energy_tags := map[string]string{
-							"serial":  serial,
-							"channel": fmt.Sprintf("%d", channel),
-						}
-						energy_fields := map[string]interface{}{
-							"watt-hours": value.WattHours,
-							"watts":      value.Watts,
-							"amps":       value.Amps,
-						}
+	reloader := &reloader{
+		path:       options.config,
+		options:    options,
+		collectors: collectors,
+		config:     config,
+		data:       data,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reloader.Run(ctx, hup)
+	}()
+
+	if config.Health != nil {
+		// followers do not serve the listener or HTTP ingest, so only
+		// the leader is ready when either is configured
+		var leading func() bool
+		if elector != nil && (config.Listen != nil || config.HTTP != nil) {
+			leading = tasks.Leading
+		}
+		health := NewHealth(config.Health, collectors.Collectors, ibgw, leading)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := health.Serve(ctx)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"address": config.Health.Address,
+				}).Error("health check server failed")
+			}
+		}()
+	}
 
-						err := ibgw.Write("energy", energy_tags, energy_fields, ts)
-						if err != nil {
-							log.WithFields(log.Fields{
-								"error":   err,
-								"tags":    energy_tags,
-								"fields":  energy_fields,
-								"gemHost": gemHost,
-							}).Error("unable to create point for energy")
-						}
-					}
-					for channel, value := range temperature_channels {
-						temperature_tags := map[string]string{
-							"serial":  serial,
-							"channel": fmt.Sprintf("%d", channel),
-						}
-						temperature_fields := map[string]interface{}{
-							"temperature": value.Temperature,
-						}
+	wg.Wait()
 
-						err := ibgw.Write("temperature", temperature_tags, temperature_fields, ts)
-						if err != nil {
-							log.WithFields(log.Fields{
-								"error":   err,
-								"tags":    temperature_tags,
-								"fields":  temperature_fields,
-								"gemHost": gemHost,
-							}).Error("unable to create point for temperature")
-						}
-					}
-					for channel, value := range pulse_channels {
-						pulse_tags := map[string]string{
-							"serial":  serial,
-							"channel": fmt.Sprintf("%d", channel),
-						}
-						pulse_fields := map[string]interface{}{
-							"pulses": value.Pulses,
-						}
+	if ibgw == nil {
+		return
+	}
 
-						err := ibgw.Write("pulses", pulse_tags, pulse_fields, ts)
-						if err != nil {
-							log.WithFields(log.Fields{
-								"error":   err,
-								"tags":    pulse_tags,
-								"fields":  pulse_fields,
-								"gemHost": gemHost,
-							}).Error("unable to create point for pulses")
-						}
-					}
-				}
-				if false {
-					break
-				}
-			}
-			wg.Done()
-		}(gemHost, ibgw, wg)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout())
+	defer cancel()
+	err = ibgw.Close(shutdownCtx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("unable to write all pending points")
+		return
 	}
-	wg.Wait()
+	log.Info("all pending points written")
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+)
+
+// DeviceConfig describes the channels of one device, keyed by serial
+// number in Config.Devices. Energy, temperature and pulse channels are
+// numbered separately. Channels that are not listed are written as they
+// are.
+type DeviceConfig struct {
+	Channels     map[int64]*ChannelConfig `json:"channels"`
+	Temperatures map[int64]*ChannelConfig `json:"temperatures"`
+	Pulses       map[int64]*ChannelConfig `json:"pulses"`
+}
+
+// ChannelConfig is what a channel measures. Name, Panel, Breaker and Room
+// are added as tags to the points written for it.
+type ChannelConfig struct {
+	Name    string `json:"name"`
+	Panel   string `json:"panel"`
+	Breaker string `json:"breaker"`
+	Room    string `json:"room"`
+	// Disabled stops anything being written for the channel.
+	Disabled bool `json:"disabled"`
+	// Invert corrects a CT installed backwards: watts are negated and the
+	// polarized watt-seconds counter counts the other direction.
+	Invert bool `json:"invert"`
+	// Scale multiplies the energy readings to correct a CT configured
+	// with the wrong ratio. Zero leaves them unscaled.
+	Scale float64 `json:"scale"`
+}
+
+func (d *DeviceConfig) Validate() error {
+	for kind, channels := range map[string]map[int64]*ChannelConfig{
+		"channel":     d.Channels,
+		"temperature": d.Temperatures,
+		"pulse":       d.Pulses,
+	} {
+		for n, channel := range channels {
+			err := validateChannel(kind, n, channel)
+			if err != nil {
+				// the field holding each kind is named after its plural
+				return &pathError{fmt.Sprintf("%ss.%d", kind, n), err}
+			}
+		}
+	}
+	return nil
+}
+
+// validateChannel checks channel n of the given kind of a device.
+func validateChannel(kind string, n int64, channel *ChannelConfig) error {
+	if n < 1 {
+		return fmt.Errorf("invalid %s number %d", kind, n)
+	}
+	if channel == nil {
+		return fmt.Errorf("%s %d: missing definition", kind, n)
+	}
+	if channel.Scale < 0 {
+		return fmt.Errorf("%s %d: scale must not be negative, use invert", kind, n)
+	}
+	if kind != "channel" && (channel.Invert || channel.Scale != 0) {
+		return fmt.Errorf("%s %d: invert and scale only apply to energy channels", kind, n)
+	}
+	return nil
+}
+
+// addTags adds the channel's metadata to tags.
+func (c *ChannelConfig) addTags(tags map[string]string) {
+	for key, value := range map[string]string{
+		"name":    c.Name,
+		"panel":   c.Panel,
+		"breaker": c.Breaker,
+		"room":    c.Room,
+	} {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+}
+
+// energy returns value corrected for the channel's polarity and scale.
+func (c *ChannelConfig) energy(value gem.EnergySample) gem.EnergySample {
+	if c.Invert {
+		value.Watts = -value.Watts
+		if value.PolarizedWattSeconds <= value.AbsoluteWattSeconds {
+			value.PolarizedWattSeconds = value.AbsoluteWattSeconds - value.PolarizedWattSeconds
+		}
+	}
+	if c.Scale != 0 {
+		value.Watts *= c.Scale
+		value.WattHours *= c.Scale
+		value.Amps *= c.Scale
+		value.AbsoluteWattSeconds = uint64(math.Round(float64(value.AbsoluteWattSeconds) * c.Scale))
+		value.PolarizedWattSeconds = uint64(math.Round(float64(value.PolarizedWattSeconds) * c.Scale))
+	}
+	return value
+}
+
+// packetConfig is the part of the configuration applied to packets as
+// they are written: device metadata and the virtual channels computed from
+// it.
+type packetConfig struct {
+	devices map[string]*DeviceConfig
+	virtual *virtualRegistry
+}
+
+// device returns the metadata for serial, or nil.
+func (c *packetConfig) device(serial string) *DeviceConfig {
+	return c.devices[serial]
+}
+
+// packetConfigRegistry holds the packetConfig in use so that it can be
+// replaced while packets are being written. It is replaced as a whole, so
+// a packet never sees device metadata and virtual channels from different
+// configurations.
+type packetConfigRegistry struct {
+	mu      sync.RWMutex
+	current *packetConfig
+}
+
+// packetConfigs is shared by every packet source.
+var packetConfigs = &packetConfigRegistry{
+	current: &packetConfig{virtual: newVirtualRegistry()},
+}
+
+// set replaces the device metadata and virtual channels. Readings recorded
+// for the previous virtual channels are forgotten.
+func (r *packetConfigRegistry) set(devices map[string]*DeviceConfig, channels map[string]*virtualChannel) {
+	virtual := newVirtualRegistry()
+	virtual.set(channels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = &packetConfig{devices: devices, virtual: virtual}
+}
+
+// get returns the packetConfig in use, which a packet should use
+// throughout.
+func (r *packetConfigRegistry) get() *packetConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// channel returns the configuration of channel n of measurement, or nil if
+// there is none.
+func (d *DeviceConfig) channel(kind string, n int64) *ChannelConfig {
+	if d == nil {
+		return nil
+	}
+	switch kind {
+	case "energy":
+		return d.Channels[n]
+	case "temperature":
+		return d.Temperatures[n]
+	case "pulses":
+		return d.Pulses[n]
+	}
+	return nil
+}
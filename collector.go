@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+	// a session that lasted at least this long resets the backoff
+	backoffResetAfter = 30 * time.Second
+)
+
+type CollectorState string
+
+const (
+	StateConnecting CollectorState = "connecting"
+	StateConnected  CollectorState = "connected"
+	StateBackoff    CollectorState = "backoff"
+	StateStopped    CollectorState = "stopped"
+)
+
+// CollectorStatus is a snapshot of a collector's connection state.
+type CollectorStatus struct {
+	Host       string
+	State      CollectorState
+	Since      time.Time
+	LastError  error
+	Reconnects int
+	// LastPacket is when the last packet was decoded, zero if none has
+	// been yet.
+	LastPacket time.Time
+}
+
+// Collector supervises the connection to a single host, redialing with
+// exponential backoff whenever the connection fails.
+type Collector struct {
+	host   *HostConfig
+	ibgw   PointWriter
+	source *sourceMetrics
+
+	// delay and resetAfter are backoff and backoffResetAfter, replaced
+	// in tests
+	delay      func(attempt int) time.Duration
+	resetAfter time.Duration
+
+	mu     sync.Mutex
+	status CollectorStatus
+}
+
+func NewCollector(host *HostConfig, ibgw PointWriter) *Collector {
+	return &Collector{
+		host:   host,
+		ibgw:   ibgw,
+		source: sources.get(host.Name()),
+
+		delay:      backoff,
+		resetAfter: backoffResetAfter,
+
+		status: CollectorStatus{
+			Host:  host.Name(),
+			State: StateConnecting,
+			Since: time.Now(),
+		},
+	}
+}
+
+func (c *Collector) Status() CollectorStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+func (c *Collector) setState(state CollectorState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state == StateBackoff {
+		c.status.Reconnects++
+	}
+	c.status.State = state
+	c.status.Since = time.Now()
+	if err != nil {
+		c.status.LastError = err
+	}
+}
+
+// received records that a packet was decoded.
+func (c *Collector) received(at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.LastPacket = at
+}
+
+// Run connects to the host and reads packets until ctx is cancelled.
+func (c *Collector) Run(ctx context.Context) {
+	defer c.setState(StateStopped, nil)
+
+	attempt := 0
+	for {
+		c.setState(StateConnecting, nil)
+		started := time.Now()
+		err := c.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) >= c.resetAfter {
+			attempt = 0
+		}
+		delay := c.delay(attempt)
+		attempt++
+
+		log.WithFields(log.Fields{
+			"error":   err,
+			"gemHost": c.host.Name(),
+			"backoff": delay,
+		}).Error("connection to host lost, reconnecting")
+		c.setState(StateBackoff, err)
+		c.source.reconnect()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// deviceConn is a connection to a device, either a TCP connection or an
+// open serial port.
+type deviceConn interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+func (c *Collector) open(ctx context.Context) (deviceConn, error) {
+	if c.host.Serial != nil {
+		return openSerial(c.host.Serial)
+	}
+	dialer := &net.Dialer{
+		KeepAlive: time.Duration(c.host.KeepAlive),
+	}
+	return dialer.DialContext(ctx, "tcp", c.host.Name())
+}
+
+// session connects to the host once and reads packets until the connection
+// fails. Every goroutine it starts has exited by the time it returns.
+func (c *Collector) session(ctx context.Context) error {
+	conn, err := c.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gemHost": c.host.Name(),
+	}).Info("connected to host")
+	c.setState(StateConnected, nil)
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		conn.Close()
+		wg.Wait()
+	}()
+
+	// unblock the reader when the collector is stopped
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-sessionCtx.Done()
+		conn.Close()
+	}()
+
+	if poll := c.host.PollCommand(); poll != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-sessionCtx.Done():
+					return
+				case <-ticker.C:
+					_, err := conn.Write([]byte(poll))
+					if err != nil {
+						log.WithFields(log.Fields{
+							"error":   err,
+							"gemHost": c.host.Name(),
+						}).Error("unable to poll host")
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var reader io.Reader = conn
+	timeout := c.host.inactivityTimeout()
+	if timeout > 0 {
+		reader = &deadlineReader{conn: conn, timeout: timeout}
+	}
+
+	err = readPackets(c.host, bufio.NewReader(reader), c.source, func(packet *gem.Packet) {
+		received := time.Now()
+		c.received(received)
+		handlePacket(c.ibgw, c.host, packet, received)
+	})
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("no data received for %s: %w", timeout, err)
+		c.stalled(timeout, err)
+	}
+	return err
+}
+
+// stalled records that the connection went quiet for longer than timeout.
+func (c *Collector) stalled(timeout time.Duration, err error) {
+	log.WithFields(log.Fields{
+		"error":   err,
+		"gemHost": c.host.Name(),
+		"timeout": timeout,
+	}).Warn("connection stalled")
+
+	tags := map[string]string{
+		"host":  c.host.Name(),
+		"event": "stall",
+	}
+	fields := map[string]interface{}{
+		"message":         err.Error(),
+		"timeout-seconds": timeout.Seconds(),
+	}
+	err = c.ibgw.Write("collector_event", tags, fields, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"tags":    tags,
+			"fields":  fields,
+			"gemHost": c.host.Name(),
+		}).Error("unable to write point for collector_event")
+	}
+}
+
+// deadlineReader extends the read deadline of conn before every read so
+// that a connection which stops sending data fails with a timeout.
+type deadlineReader struct {
+	conn    deviceConn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	err := r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	if err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
+
+// backoff returns the delay before reconnect attempt n, doubling from
+// initialBackoff up to maxBackoff with up to half of it randomised.
+func backoff(attempt int) time.Duration {
+	d := initialBackoff
+	for i := 0; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt, base := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute,
+	} {
+		for i := 0; i < 100; i++ {
+			if delay := backoff(attempt); delay < base/2 || delay > base {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", attempt, delay, base/2, base)
+			}
+		}
+	}
+}
+
+// waitForState polls the collector until it reaches state.
+func waitForState(t *testing.T, collector *Collector, state CollectorState) CollectorStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := collector.Status()
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("collector is %s, want %s", status.State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCollectorReconnects(t *testing.T) {
+	device := newTestDevice(t)
+	collector := NewCollector(&HostConfig{Address: device.address(), Format: "ascii"}, &recordingWriter{})
+	attempts := make(chan int, 10)
+	collector.delay = func(attempt int) time.Duration {
+		attempts <- attempt
+		return 200 * time.Millisecond
+	}
+	collector.resetAfter = 300 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		collector.Run(ctx)
+	}()
+	expectAttempt := func(want int) {
+		t.Helper()
+		select {
+		case got := <-attempts:
+			if got != want {
+				t.Errorf("backoff attempt %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("collector did not back off")
+		}
+	}
+
+	// the backoff grows while connections fail straight away
+	for attempt := 0; attempt < 2; attempt++ {
+		conn := device.accept(t)
+		waitForState(t, collector, StateConnected)
+		conn.Close()
+		expectAttempt(attempt)
+		status := waitForState(t, collector, StateBackoff)
+		if status.Reconnects != attempt+1 || status.LastError == nil {
+			t.Errorf("status = %+v, want %d reconnects and an error", status, attempt+1)
+		}
+	}
+
+	// and is reset by a connection that lasted
+	conn := device.accept(t)
+	waitForState(t, collector, StateConnected)
+	time.Sleep(400 * time.Millisecond)
+	conn.Close()
+	expectAttempt(0)
+
+	waitForState(t, collector, StateBackoff)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return once cancelled")
+	}
+	if state := collector.Status().State; state != StateStopped {
+		t.Errorf("collector is %s after stopping, want %s", state, StateStopped)
+	}
+}
+
+func TestCollectorReconnectsWhenStalled(t *testing.T) {
+	device := newTestDevice(t)
+	writer := &recordingWriter{}
+	host := &HostConfig{
+		Address:           device.address(),
+		Format:            "ascii",
+		InactivityTimeout: Duration(200 * time.Millisecond),
+	}
+	collector := NewCollector(host, writer)
+	collector.delay = func(int) time.Duration { return 10 * time.Millisecond }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		collector.Run(ctx)
+	}()
+	defer func() {
+		<-done
+	}()
+	defer cancel()
+
+	// packets arriving more often than the timeout keep the connection
+	conn := device.accept(t)
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write([]byte("n=01000123&v=120.5&p_1=100\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-device.conns:
+		t.Fatal("collector reconnected while packets were arriving")
+	default:
+	}
+	if _, ok := writer.find("collector_event"); ok {
+		t.Fatal("collector_event written for a connection that was not stalled")
+	}
+
+	// then the device goes quiet without closing the connection
+	device.accept(t)
+	point, ok := writer.find("collector_event")
+	if !ok {
+		t.Fatal("no collector_event written for the stall")
+	}
+	if point.tags["event"] != "stall" || point.tags["host"] != device.address() {
+		t.Errorf("collector_event tags = %v", point.tags)
+	}
+	if status := collector.Status(); status.LastError == nil || !strings.Contains(status.LastError.Error(), "no data received for 200ms") {
+		t.Errorf("last error = %v, want a stall", status.LastError)
+	}
+}
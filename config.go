@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	"github.com/adamjacobmuller/brul2influx/influxbg"
+)
+
+type Config struct {
+	Hosts    []*HostConfig     `json:"hosts"`
+	Listen   *ListenConfig     `json:"listen"`
+	HTTP     *HTTPIngestConfig `json:"http"`
+	InfluxDB InfluxDBConfig    `json:"influxdb"`
+	Spool    *SpoolConfig      `json:"spool"`
+	// Prometheus exposes the latest readings for scraping. InfluxDB may
+	// be left unconfigured when it or MQTT is set.
+	Prometheus *PrometheusConfig `json:"prometheus"`
+	// MQTT publishes the latest readings to a broker.
+	MQTT *MQTTConfig `json:"mqtt"`
+	// SelfMetrics writes brul2influx's own metrics to InfluxDB; they are
+	// always exposed to Prometheus.
+	SelfMetrics *SelfMetricsConfig `json:"self_metrics"`
+	Health      *HealthConfig      `json:"health"`
+	// Devices names and corrects channels, keyed by serial number.
+	Devices         map[string]*DeviceConfig `json:"devices"`
+	VirtualChannels []*VirtualChannelConfig  `json:"virtual_channels"`
+	// LeaderElection makes only one replica collect from Hosts and accept
+	// packets on Listen and HTTP.
+	LeaderElection *LeaderElectionConfig `json:"leader_election"`
+	// ShutdownTimeout bounds how long pending points are written for on
+	// shutdown; it defaults to defaultShutdownTimeout.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// lines locates values in the file the configuration was parsed
+	// from, for Validate's errors.
+	lines configLines
+}
+
+// defaultShutdownTimeout leaves headroom within Kubernetes' default 30s
+// termination grace period.
+const defaultShutdownTimeout = 25 * time.Second
+
+func (c *Config) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(c.ShutdownTimeout)
+}
+
+// SpoolConfig enables the on-disk spool for points that can not be
+// written to InfluxDB; see influxbg.SpoolConfig.
+type SpoolConfig struct {
+	Dir             string   `json:"dir"`
+	SegmentMaxBytes int64    `json:"segment_max_bytes"`
+	MaxBytes        int64    `json:"max_bytes"`
+	MaxAge          Duration `json:"max_age"`
+	// Fsync is one of "always", "rotate" (the default) or "never".
+	Fsync string `json:"fsync"`
+}
+
+func (s *SpoolConfig) influxbg() *influxbg.SpoolConfig {
+	return &influxbg.SpoolConfig{
+		Dir:             s.Dir,
+		SegmentMaxBytes: s.SegmentMaxBytes,
+		MaxBytes:        s.MaxBytes,
+		MaxAge:          time.Duration(s.MaxAge),
+		Fsync:           influxbg.FsyncPolicy(s.Fsync),
+	}
+}
+
+// HostConfig describes a single device to dial, or to open when Serial is
+// set. For backwards compatibility it may also be given as a plain
+// "host:port" string.
+type HostConfig struct {
+	Address string        `json:"address"`
+	Serial  *SerialConfig `json:"serial"`
+	// Format is one of "ascii", "binary" or "auto" (the default), in
+	// which case it is detected from the first bytes on the connection.
+	Format string `json:"format"`
+	// Device is one of "gem" (the default), "ecm1240" or "ecm1220".
+	Device string `json:"device"`
+	// Poll overrides the command written every second to request a
+	// packet. GEMs default to "^^^APISPK"; ECMs default to no polling as
+	// they are expected to be in real-time mode.
+	Poll *string `json:"poll"`
+	// InactivityTimeout is how long a connection may go without receiving
+	// any data before it is considered stalled and reconnected. Zero uses
+	// defaultInactivityTimeout; a negative value disables stall detection.
+	InactivityTimeout Duration `json:"inactivity_timeout"`
+	// KeepAlive is the TCP keepalive period. Zero uses the Go default; a
+	// negative value disables keepalives.
+	KeepAlive Duration `json:"keepalive"`
+	// SecondsCounter writes the device's own seconds counter as the
+	// "seconds" field of the voltage measurement, so that duplicate or
+	// missing packets show up as repeated values or gaps.
+	SecondsCounter bool `json:"seconds_counter"`
+	// Timestamps is "device" (the default) to derive timestamps from the
+	// device's seconds counter, or "received" to use the time each packet
+	// was decoded.
+	Timestamps string `json:"timestamps"`
+}
+
+const defaultInactivityTimeout = 30 * time.Second
+
+func (h *HostConfig) inactivityTimeout() time.Duration {
+	if h.InactivityTimeout == 0 {
+		return defaultInactivityTimeout
+	}
+	return time.Duration(h.InactivityTimeout)
+}
+
+// Name identifies the host in logs and tags.
+func (h *HostConfig) Name() string {
+	if h.Serial != nil {
+		return h.Serial.Device
+	}
+	return h.Address
+}
+
+// Model returns the gem package model name for the configured device, or
+// an empty string for a GEM.
+func (h *HostConfig) Model() string {
+	switch h.Device {
+	case "ecm1240":
+		return gem.ModelECM1240
+	case "ecm1220":
+		return gem.ModelECM1220
+	}
+	return ""
+}
+
+func (h *HostConfig) PollCommand() string {
+	if h.Poll != nil {
+		return *h.Poll
+	}
+	if h.Model() != "" {
+		return ""
+	}
+	return "^^^APISPK"
+}
+
+func (h *HostConfig) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*h = HostConfig{Address: address}
+		return nil
+	}
+
+	type plain HostConfig
+	return json.Unmarshal(data, (*plain)(h))
+}
+
+func validTimestamps(timestamps string) bool {
+	switch timestamps {
+	case "", "device", "received":
+		return true
+	}
+	return false
+}
+
+// Validate checks the whole configuration, returning every problem found
+// joined into one error, one per line.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(path string, err error) {
+		errs = append(errs, c.lines.at(path, err))
+	}
+
+	if c.InfluxDB.Address != "" || (c.Prometheus == nil && c.MQTT == nil) {
+		err := c.InfluxDB.Validate()
+		if err != nil {
+			fail("influxdb", fmt.Errorf("influxdb: %w", err))
+		}
+	}
+	if c.MQTT != nil {
+		err := c.MQTT.Validate()
+		if err != nil {
+			fail("mqtt", fmt.Errorf("mqtt: %w", err))
+		}
+	}
+	serials := make([]string, 0, len(c.Devices))
+	for serial := range c.Devices {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	devicesValid := true
+	for _, serial := range serials {
+		device := c.Devices[serial]
+		if device == nil {
+			fail("devices."+serial, fmt.Errorf("device %s: missing definition", serial))
+			devicesValid = false
+			continue
+		}
+		err := device.Validate()
+		if err != nil {
+			fail("devices."+serial, fmt.Errorf("device %s: %w", serial, err))
+			devicesValid = false
+		}
+	}
+	// virtual channels can only be checked against valid devices
+	if devicesValid {
+		_, err := compileVirtualChannels(c.VirtualChannels, c.Devices)
+		if err != nil {
+			fail("virtual_channels", err)
+		}
+	}
+	if c.Health != nil && c.Health.Address == "" {
+		fail("health", fmt.Errorf("health: missing address"))
+	}
+	if c.LeaderElection != nil {
+		err := c.LeaderElection.Validate()
+		if err != nil {
+			fail("leader_election", fmt.Errorf("leader_election: %w", err))
+		}
+	}
+	if c.SelfMetrics != nil && c.InfluxDB.Address == "" {
+		fail("self_metrics", fmt.Errorf("self_metrics: needs influxdb"))
+	}
+	if c.Prometheus != nil {
+		if c.Prometheus.Address == "" {
+			fail("prometheus", fmt.Errorf("prometheus: missing address"))
+		}
+		if c.Prometheus.Path != "" && !strings.HasPrefix(c.Prometheus.Path, "/") {
+			fail("prometheus.path", fmt.Errorf("prometheus: path %q must start with /", c.Prometheus.Path))
+		}
+	}
+	hosts := make(map[string]bool)
+	for i, host := range c.Hosts {
+		err := validateHost(host, hosts)
+		if err != nil {
+			fail(fmt.Sprintf("hosts[%d]", i), err)
+		}
+	}
+	if c.Listen != nil {
+		if c.Listen.Address == "" {
+			fail("listen", fmt.Errorf("listen: missing address"))
+		}
+		switch c.Listen.Format {
+		case "", "auto", "ascii", "binary":
+		default:
+			fail("listen.format", fmt.Errorf("listen: unknown format %q", c.Listen.Format))
+		}
+		if !validTimestamps(c.Listen.Timestamps) {
+			fail("listen.timestamps", fmt.Errorf("listen: unknown timestamps %q", c.Listen.Timestamps))
+		}
+		_, err := parseAllowList(c.Listen.Allow)
+		if err != nil {
+			fail("listen.allow", fmt.Errorf("listen: %w", err))
+		}
+	}
+	if c.Spool != nil {
+		if c.Spool.Dir == "" {
+			fail("spool", fmt.Errorf("spool: missing dir"))
+		}
+		if c.InfluxDB.Address == "" {
+			fail("spool", fmt.Errorf("spool: needs influxdb"))
+		}
+		switch c.Spool.Fsync {
+		case "", "always", "rotate", "never":
+		default:
+			fail("spool.fsync", fmt.Errorf("spool: unknown fsync policy %q", c.Spool.Fsync))
+		}
+	}
+	if c.HTTP != nil {
+		if c.HTTP.Address == "" {
+			fail("http", fmt.Errorf("http: missing address"))
+		}
+		if c.HTTP.Path != "" && !strings.HasPrefix(c.HTTP.Path, "/") {
+			fail("http.path", fmt.Errorf("http: path %q must start with /", c.HTTP.Path))
+		}
+		if !validTimestamps(c.HTTP.Timestamps) {
+			fail("http.timestamps", fmt.Errorf("http: unknown timestamps %q", c.HTTP.Timestamps))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateHost checks one entry of Hosts, recording its name in seen to
+// find hosts listed twice.
+func validateHost(host *HostConfig, seen map[string]bool) error {
+	if host == nil {
+		return fmt.Errorf("host without address")
+	}
+	if host.Serial != nil {
+		if host.Address != "" {
+			return fmt.Errorf("host %s: address and serial are mutually exclusive", host.Address)
+		}
+		err := host.Serial.Validate()
+		if err != nil {
+			return &pathError{"serial", fmt.Errorf("host %s: %w", host.Serial.Device, err)}
+		}
+	} else if host.Address == "" {
+		return fmt.Errorf("host without address")
+	}
+	if seen[host.Name()] {
+		return fmt.Errorf("host %s: listed more than once", host.Name())
+	}
+	seen[host.Name()] = true
+	switch host.Format {
+	case "", "auto", "ascii", "binary":
+	default:
+		return &pathError{"format", fmt.Errorf("host %s: unknown format %q", host.Name(), host.Format)}
+	}
+	if !validTimestamps(host.Timestamps) {
+		return &pathError{"timestamps", fmt.Errorf("host %s: unknown timestamps %q", host.Name(), host.Timestamps)}
+	}
+	switch host.Device {
+	case "", "gem":
+	case "ecm1240", "ecm1220":
+		if host.Format == "ascii" {
+			return fmt.Errorf("host %s: %s devices only support the binary format", host.Name(), host.Device)
+		}
+	default:
+		return &pathError{"device", fmt.Errorf("host %s: unknown device %q", host.Name(), host.Device)}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// loadConfig reads a configuration file; see parseConfig.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// parseConfig decodes a configuration in JSON or YAML, which is a superset
+// of it. Unknown fields and values of the wrong type are errors, reported
+// with their line numbers; every one found is returned joined together.
+func parseConfig(data []byte) (*Config, error) {
+	// YAML reports JSON syntax errors at the start of the enclosing object
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var value interface{}
+		err := json.Unmarshal(data, &value)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := position(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("line %d, column %d: %w", line, column, err)
+		}
+	}
+
+	var root yaml.Node
+	err := yaml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return nil, fmt.Errorf("empty configuration")
+	}
+
+	checker := &configChecker{lines: make(configLines)}
+	value := checker.convert(root.Content[0], reflect.TypeOf(Config{}), "")
+	if len(checker.errs) > 0 {
+		return nil, errors.Join(checker.errs...)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	err = json.Unmarshal(encoded, config)
+	if err != nil {
+		return nil, err
+	}
+	config.lines = checker.lines
+	return config, nil
+}
+
+// position returns the line and column of offset in data, counting from 1.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// configLines maps the path of each value in a configuration file, such
+// as "hosts[1]" or "devices.01000123.channels.3", to the line it starts
+// on, so that errors found validating it can point at the file.
+type configLines map[string]int
+
+// at prefixes err with the line of the value at path, or of the closest
+// value enclosing it. A *pathError within err locates it further inside
+// that value.
+func (l configLines) at(path string, err error) error {
+	var pathErr *pathError
+	if errors.As(err, &pathErr) {
+		path = joinPath(path, pathErr.path)
+	}
+	for path != "" {
+		if line, ok := l[path]; ok {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	return err
+}
+
+// pathError is an error about the value at path within the value being
+// validated, for configLines.at to find its line.
+type pathError struct {
+	path string
+	err  error
+}
+
+func (e *pathError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pathError) Unwrap() error {
+	return e.err
+}
+
+// configChecker converts a YAML document to values that encode to the
+// JSON the configuration types expect, checking it against them as it
+// goes, and records where each value is.
+type configChecker struct {
+	errs  []error
+	lines configLines
+}
+
+// locate records the line of the value at path, unless it is already
+// known from the key the value belongs to.
+func (c *configChecker) locate(path string, line int) {
+	if _, ok := c.lines[path]; !ok && path != "" {
+		c.lines[path] = line
+	}
+}
+
+func (c *configChecker) errorf(node *yaml.Node, path, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if path != "" {
+		message = path + ": " + message
+	}
+	c.errs = append(c.errs, fmt.Errorf("line %d: %s", node.Line, message))
+}
+
+// convert returns node as a value for json.Marshal, checked against t.
+func (c *configChecker) convert(node *yaml.Node, t reflect.Type, path string) interface{} {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	c.locate(path, node.Line)
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+
+	// types that decode themselves accept more than their fields, such as
+	// a plain string, so only mappings are checked against their fields
+	if reflect.PointerTo(t).Implements(jsonUnmarshaler) {
+		errs := len(c.errs)
+		var value interface{}
+		if node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct {
+			value = c.convertStruct(node, t, path)
+		} else {
+			value = c.convert(node, reflect.TypeOf((*interface{})(nil)).Elem(), path)
+		}
+		if len(c.errs) > errs {
+			return value
+		}
+		encoded, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(encoded, reflect.New(t).Interface())
+		}
+		if err != nil {
+			c.errorf(node, path, "%s", err)
+		}
+		return value
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.convert(node, t.Elem(), path)
+
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			c.errorf(node, path, "expected a mapping")
+			return nil
+		}
+		return c.convertStruct(node, t, path)
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			c.errorf(node, path, "expected a mapping")
+			return nil
+		}
+		value := make(map[string]interface{})
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, item := node.Content[i], node.Content[i+1]
+			switch t.Key().Kind() {
+			case reflect.Int, reflect.Int64:
+				_, err := strconv.ParseInt(key.Value, 10, 64)
+				if err != nil {
+					c.errorf(key, path, "key %q is not a number", key.Value)
+					continue
+				}
+			}
+			c.locate(joinPath(path, key.Value), key.Line)
+			value[key.Value] = c.convert(item, t.Elem(), joinPath(path, key.Value))
+		}
+		return value
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			c.errorf(node, path, "expected a list")
+			return nil
+		}
+		value := make([]interface{}, 0, len(node.Content))
+		for i, item := range node.Content {
+			value = append(value, c.convert(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)))
+		}
+		return value
+
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			c.errorf(node, path, "expected a string")
+			return nil
+		}
+		// unquoted YAML such as a serial number may look like a number
+		return node.Value
+
+	case reflect.Bool:
+		var value bool
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" || node.Decode(&value) != nil {
+			c.errorf(node, path, "expected true or false")
+			return nil
+		}
+		return value
+
+	case reflect.Int, reflect.Int64:
+		var value int64
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" || node.Decode(&value) != nil {
+			c.errorf(node, path, "expected an integer")
+			return nil
+		}
+		return value
+
+	case reflect.Float64:
+		var value float64
+		if node.Kind != yaml.ScalarNode || (node.Tag != "!!int" && node.Tag != "!!float") || node.Decode(&value) != nil {
+			c.errorf(node, path, "expected a number")
+			return nil
+		}
+		return value
+
+	case reflect.Interface:
+		switch node.Kind {
+		case yaml.MappingNode:
+			return c.convert(node, reflect.TypeOf(map[string]interface{}{}), path)
+		case yaml.SequenceNode:
+			return c.convert(node, reflect.TypeOf([]interface{}{}), path)
+		}
+		var value interface{}
+		if node.Tag == "!!timestamp" || node.Decode(&value) != nil {
+			return node.Value
+		}
+		return value
+	}
+
+	c.errorf(node, path, "unsupported type %s", t)
+	return nil
+}
+
+// convertStruct checks the keys of a mapping against the fields of t,
+// matched by their JSON names as encoding/json does.
+func (c *configChecker) convertStruct(node *yaml.Node, t reflect.Type, path string) map[string]interface{} {
+	value := make(map[string]interface{})
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, item := node.Content[i], node.Content[i+1]
+		field, ok := jsonField(t, key.Value)
+		if !ok {
+			c.errorf(key, path, "unknown field %q", key.Value)
+			continue
+		}
+		c.locate(joinPath(path, key.Value), key.Line)
+		value[key.Value] = c.convert(item, field.Type, joinPath(path, key.Value))
+	}
+	return value
+}
+
+// jsonField finds the field of t that encoding/json decodes name into,
+// preferring an exact match over a case-insensitive one.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	var fold *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldName := field.Name
+		if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			fieldName = tag
+		}
+		if fieldName == name {
+			return field, true
+		}
+		if fold == nil && strings.EqualFold(fieldName, name) {
+			fold = &field
+		}
+	}
+	if fold != nil {
+		return *fold, true
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path, name string) string {
+	if path == "" || name == "" {
+		return path + name
+	}
+	if strings.HasPrefix(name, "[") {
+		return path + name
+	}
+	return path + "." + name
+}
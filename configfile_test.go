@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	yaml := `
+hosts:
+  - gem1:8000
+  - address: gem2:8000
+    device: ecm1240
+influxdb: http://influx:8086
+shutdown_timeout: 10s
+devices:
+  01000123:
+    channels:
+      1: {name: oven, invert: true, scale: 2}
+`
+	json := `{
+	"hosts": ["gem1:8000", {"address": "gem2:8000", "device": "ecm1240"}],
+	"influxdb": "http://influx:8086",
+	"shutdown_timeout": 10,
+	"devices": {"01000123": {"channels": {"1": {"name": "oven", "invert": true, "scale": 2}}}}
+}`
+	for name, data := range map[string]string{"yaml": yaml, "json": json} {
+		config, err := parseConfig([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: parseConfig() error = %v", name, err)
+		}
+		if len(config.Hosts) != 2 || config.Hosts[0].Address != "gem1:8000" || config.Hosts[1].Device != "ecm1240" {
+			t.Errorf("%s: hosts = %+v %+v", name, config.Hosts[0], config.Hosts[1])
+		}
+		if config.InfluxDB.Address != "http://influx:8086" || config.shutdownTimeout() != 10*time.Second {
+			t.Errorf("%s: influxdb = %+v, shutdown timeout %v", name, config.InfluxDB, config.shutdownTimeout())
+		}
+		channel := config.Devices["01000123"].channel("energy", 1)
+		if channel == nil || channel.Name != "oven" || !channel.Invert || channel.Scale != 2 {
+			t.Errorf("%s: channel = %+v", name, channel)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "json syntax",
+			data: "{\n  \"hosts\": [\"gem1:8000\",\n  \"influxdb\": \"x\"\n}",
+			want: []string{"line 3, column 14: invalid character ':'"},
+		},
+		{
+			name: "yaml syntax",
+			data: "hosts:\n  - gem1:8000\n influxdb: x\n",
+			want: []string{"yaml: line 2: did not find expected key"},
+		},
+		{
+			name: "unknown fields",
+			data: "hosts:\n  - address: gem1:8000\n    fromat: ascii\ninfluxdb:\n  adress: x\n",
+			want: []string{
+				`line 3: hosts[0]: unknown field "fromat"`,
+				`line 5: influxdb: unknown field "adress"`,
+			},
+		},
+		{
+			name: "types",
+			data: "hosts: gem1:8000\nspool:\n  max_bytes: lots\n  max_age: 5x\ndevices:\n  '1':\n    channels:\n      one: {}\n",
+			want: []string{
+				"line 1: hosts: expected a list",
+				"line 3: spool.max_bytes: expected an integer",
+				`line 4: spool.max_age: time: unknown unit "x"`,
+				`line 8: devices.1.channels: key "one" is not a number`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.data))
+			if err == nil {
+				t.Fatal("parseConfig() succeeded")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.want) {
+				t.Errorf("parseConfig() error = %v, want %d errors", err, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if i >= len(lines) || !strings.HasPrefix(lines[i], want) {
+					t.Errorf("parseConfig() error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	const influxdb = "influxdb:\n  address: http://influxdb:8086\n"
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{name: "valid", data: "hosts: [gem1:8000]\n"},
+		{
+			name: "host",
+			data: "hosts:\n  - gem1:8000\n  - address: gem2:8000\n    format: hex\n",
+			want: []string{`:4: host gem2:8000: unknown format "hex"`},
+		},
+		{
+			name: "device channel",
+			data: "hosts: [gem1:8000]\ndevices:\n  '01000123':\n    channels:\n      1: {name: oven}\n      2:\n        scale: -1\n",
+			want: []string{":6: device 01000123: channel 2: scale must not be negative"},
+		},
+		{
+			name: "virtual channel",
+			data: "hosts: [gem1:8000]\ndevices:\n  '01000123': {}\nvirtual_channels:\n  - name: house\n    expression: 01000123:1 +\n",
+			want: []string{":6: virtual channel house: unexpected end of expression"},
+		},
+		{
+			name: "allow list",
+			data: "hosts: [gem1:8000]\nlisten:\n  address: :8000\n  allow: [10.0.0.0/33]\n",
+			want: []string{`:4: listen: invalid network "10.0.0.0/33" in allow list`},
+		},
+		{
+			name: "every error",
+			data: "hosts:\n  - gem1:8000\n  - address: gem2:8000\n    format: hex\nlisten:\n  address: :8000\n  allow: [10.0.0.0/33]\n",
+			want: []string{
+				`:4: host gem2:8000: unknown format "hex"`,
+				`:7: listen: invalid network "10.0.0.0/33" in allow list`,
+			},
+		},
+		{
+			name: "syntax",
+			data: "{\n  \"hosts\": [\"gem1:8000\",\n  \"influxdb\": \"x\"\n}",
+			want: []string{":3:14: invalid character ':'"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.data+influxdb), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			status := validateCommand([]string{path}, stdout, stderr)
+			if tt.want == nil {
+				if status != 0 || stdout.String() != path+": ok\n" {
+					t.Errorf("validateCommand() = %d, output %q %q", status, stdout, stderr)
+				}
+				return
+			}
+			lines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+			if status != 1 || len(lines) != len(tt.want) {
+				t.Fatalf("validateCommand() = %d, output %q, want %d errors", status, stderr, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i], path+want) {
+					t.Errorf("error %d = %q, want %q", i, lines[i], path+want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	env := map[string]string{
+		"BRUL2INFLUX_CONFIG":    "/etc/brul2influx.yaml",
+		"BRUL2INFLUX_LOG_LEVEL": "warn",
+		"BRUL2INFLUX_HEALTH":    ":8081",
+	}
+	options, err := parseOptions([]string{"-log-level", "debug", "-prometheus", ":9100"}, func(name string) string {
+		return env[name]
+	}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.config != "/etc/brul2influx.yaml" || options.logLevel.String() != "debug" {
+		t.Errorf("options = %+v", options)
+	}
+
+	config := &Config{Health: &HealthConfig{Address: ":80", MaxBacklog: 5}}
+	options.apply(config)
+	if config.Health.Address != ":8081" || config.Health.MaxBacklog != 5 {
+		t.Errorf("health = %+v", config.Health)
+	}
+	if config.Prometheus == nil || config.Prometheus.Address != ":9100" || config.Listen != nil {
+		t.Errorf("prometheus = %+v, listen = %+v", config.Prometheus, config.Listen)
+	}
+
+	_, err = parseOptions([]string{"-log-level", "loud"}, func(string) string { return "" }, io.Discard)
+	if err == nil {
+		t.Error("parseOptions() accepted an invalid log level")
+	}
+}
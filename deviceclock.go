@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// deviceSecondsModulo is where the 3 byte seconds counter wraps.
+	deviceSecondsModulo = 1 << 24
+	// driftSlew is the fraction of the difference between a derived
+	// timestamp and the arrival time that is corrected per packet.
+	driftSlew = 100
+	// driftResync is how far a derived timestamp may fall behind the
+	// arrival time before it is re-anchored outright.
+	driftResync = 5 * time.Minute
+	// packetStatsInterval is how often packet accounting is written when
+	// nothing noteworthy happens.
+	packetStatsInterval = time.Minute
+)
+
+// deviceClock follows one device's seconds counter.
+type deviceClock struct {
+	seconds   int64
+	timestamp time.Time
+	// interval is the smallest step seen between packets, taken to be
+	// the rate the device sends at.
+	interval int64
+
+	packets    uint64
+	gaps       uint64
+	duplicates uint64
+	reboots    uint64
+	reported   time.Time
+}
+
+// deviceStats is a snapshot of a device's packet accounting.
+type deviceStats struct {
+	Packets    uint64
+	Gaps       uint64
+	Duplicates uint64
+	Reboots    uint64
+}
+
+// deviceClocks derives packet timestamps from device seconds counters,
+// keyed by serial number so that they survive reconnects.
+type deviceClocks struct {
+	mu      sync.Mutex
+	devices map[string]*deviceClock
+}
+
+func newDeviceClocks() *deviceClocks {
+	return &deviceClocks{
+		devices: make(map[string]*deviceClock),
+	}
+}
+
+// clocks is shared by every packet source.
+var clocks = newDeviceClocks()
+
+// observe returns the timestamp for packet, received at received. The
+// first packet from a device is anchored to its arrival time and later
+// ones are placed by how far the seconds counter has advanced. Since a
+// packet can only arrive after it was sent, a derived timestamp later than
+// the arrival time is pulled back to it; one earlier is slewed towards it
+// gradually to follow drift between the device and wall clocks without
+// passing network jitter on. Stats are returned when they are due to be
+// written.
+func (c *deviceClocks) observe(gemHost string, packet *gem.Packet, received time.Time) (time.Time, *deviceStats) {
+	if !packet.HasSeconds || packet.Serial == "" {
+		return received, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	device, ok := c.devices[packet.Serial]
+	if !ok {
+		device = &deviceClock{
+			seconds:   packet.Seconds,
+			timestamp: received,
+			packets:   1,
+			reported:  received,
+		}
+		c.devices[packet.Serial] = device
+		return received, nil
+	}
+
+	device.packets++
+	event := false
+	delta := (packet.Seconds - device.seconds + deviceSecondsModulo) % deviceSecondsModulo
+	timestamp := device.timestamp
+
+	switch {
+	case delta == 0:
+		device.duplicates++
+		event = true
+	case delta >= deviceSecondsModulo/2:
+		// the counter went backwards, so the device restarted
+		device.reboots++
+		event = true
+		log.WithFields(log.Fields{
+			"gemHost":  gemHost,
+			"serial":   packet.Serial,
+			"previous": device.seconds,
+			"seconds":  packet.Seconds,
+		}).Warn("device seconds counter went backwards, assuming a reboot")
+		timestamp = received
+	default:
+		if device.interval == 0 || delta < device.interval {
+			device.interval = delta
+		}
+		if missed := (delta+device.interval/2)/device.interval - 1; missed > 0 {
+			device.gaps += uint64(missed)
+			event = true
+			log.WithFields(log.Fields{
+				"gemHost":  gemHost,
+				"serial":   packet.Serial,
+				"previous": device.seconds,
+				"seconds":  packet.Seconds,
+				"missed":   missed,
+			}).Warn("missed packets from device")
+		}
+		timestamp = timestamp.Add(time.Duration(delta) * time.Second)
+	}
+
+	switch offset := received.Sub(timestamp); {
+	case offset < 0:
+		timestamp = received
+	case offset > driftResync:
+		log.WithFields(log.Fields{
+			"gemHost": gemHost,
+			"serial":  packet.Serial,
+			"offset":  offset,
+		}).Warn("device clock drifted too far, re-anchoring to arrival time")
+		timestamp = received
+	default:
+		timestamp = timestamp.Add(offset / driftSlew)
+	}
+
+	device.seconds = packet.Seconds
+	device.timestamp = timestamp
+
+	if !event && received.Sub(device.reported) < packetStatsInterval {
+		return timestamp, nil
+	}
+	device.reported = received
+	return timestamp, &deviceStats{
+		Packets:    device.packets,
+		Gaps:       device.gaps,
+		Duplicates: device.duplicates,
+		Reboots:    device.reboots,
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+)
+
+func secondsPacket(serial string, seconds int64) *gem.Packet {
+	return &gem.Packet{Serial: serial, Seconds: seconds, HasSeconds: true}
+}
+
+func TestDeviceClocksTimestamps(t *testing.T) {
+	c := newDeviceClocks()
+	start := time.Unix(1700000000, 0)
+
+	// arrivals jitter by up to half a second but timestamps stay a second
+	// apart
+	jitter := []time.Duration{0, 300, 50, 500, 120, 0}
+	for i, j := range jitter {
+		received := start.Add(time.Duration(i)*time.Second + j*time.Millisecond)
+		ts, _ := c.observe("gem", secondsPacket("1", 1000+int64(i)), received)
+		want := start.Add(time.Duration(i) * time.Second)
+		if diff := ts.Sub(want); diff < 0 || diff > 20*time.Millisecond {
+			t.Errorf("packet %d: timestamp %v off by %v", i, ts, diff)
+		}
+	}
+
+	// a packet can not arrive before it was sent
+	received := start.Add(5500 * time.Millisecond)
+	ts, _ := c.observe("gem", secondsPacket("1", 1008), received)
+	if !ts.Equal(received) {
+		t.Errorf("timestamp ahead of arrival: %v, want %v", ts, received)
+	}
+}
+
+func TestDeviceClocksAccounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds []int64
+		want    deviceStats
+	}{
+		{
+			name:    "steady",
+			seconds: []int64{10, 11, 12, 13},
+			want:    deviceStats{Packets: 4},
+		},
+		{
+			name:    "gap",
+			seconds: []int64{10, 11, 14, 15},
+			want:    deviceStats{Packets: 4, Gaps: 2},
+		},
+		{
+			name:    "gap at a slower rate",
+			seconds: []int64{0, 5, 10, 25},
+			want:    deviceStats{Packets: 4, Gaps: 2},
+		},
+		{
+			name:    "duplicate",
+			seconds: []int64{10, 11, 11, 12},
+			want:    deviceStats{Packets: 4, Duplicates: 1},
+		},
+		{
+			name:    "reboot",
+			seconds: []int64{5000, 5001, 3, 4},
+			want:    deviceStats{Packets: 4, Reboots: 1},
+		},
+		{
+			name:    "counter wraps",
+			seconds: []int64{deviceSecondsModulo - 2, deviceSecondsModulo - 1, 0, 1},
+			want:    deviceStats{Packets: 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newDeviceClocks()
+			received := time.Unix(1700000000, 0)
+			for _, seconds := range tt.seconds {
+				c.observe("gem", secondsPacket("1", seconds), received)
+				received = received.Add(time.Second)
+			}
+
+			// stats are always reported once the interval has passed
+			_, stats := c.observe("gem", secondsPacket("1", tt.seconds[len(tt.seconds)-1]+1), received.Add(packetStatsInterval))
+			if stats == nil {
+				t.Fatal("no stats reported after interval")
+			}
+			want := tt.want
+			want.Packets++
+			if *stats != want {
+				t.Errorf("stats = %+v, want %+v", *stats, want)
+			}
+		})
+	}
+}
+
+func TestDeviceClocksReportsEvents(t *testing.T) {
+	c := newDeviceClocks()
+	received := time.Unix(1700000000, 0)
+
+	c.observe("gem", secondsPacket("1", 10), received)
+	if _, stats := c.observe("gem", secondsPacket("1", 11), received.Add(time.Second)); stats != nil {
+		t.Errorf("stats reported without an event: %+v", stats)
+	}
+	_, stats := c.observe("gem", secondsPacket("1", 5), received.Add(2*time.Second))
+	if stats == nil || stats.Reboots != 1 {
+		t.Errorf("stats after reboot = %+v", stats)
+	}
+
+	ts, stats := c.observe("gem", &gem.Packet{Serial: "1"}, received)
+	if !ts.Equal(received) || stats != nil {
+		t.Errorf("packet without seconds: timestamp %v, stats %+v", ts, stats)
+	}
+}
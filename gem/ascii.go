@@ -0,0 +1,118 @@
+package gem
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseASCII decodes a GEM packet in the key=value&key=value ASCII format.
+//
+// Fields that can not be decoded are skipped and reported through a
+// *ParseError; the returned packet is still usable in that case. A nil
+// packet is only returned for ErrEmptyPacket.
+func ParseASCII(data []byte) (*Packet, error) {
+	dataTrim := strings.TrimSpace(string(data))
+	if dataTrim == "" {
+		return nil, ErrEmptyPacket
+	}
+
+	packet := newPacket()
+	packet.Format = FormatASCII
+	var fieldErrors []*FieldError
+
+	fail := func(pair, key, value string, err, cause error) {
+		fieldErrors = append(fieldErrors, &FieldError{
+			Pair:  pair,
+			Key:   key,
+			Value: value,
+			Err:   err,
+			Cause: cause,
+		})
+	}
+
+	for _, dataPoint := range strings.Split(dataTrim, "&") {
+		dataPointSplit := strings.Split(dataPoint, "=")
+		if len(dataPointSplit) != 2 {
+			fail(dataPoint, "", "", ErrMalformedPair, nil)
+			continue
+		}
+		dataPointKey := dataPointSplit[0]
+		dataPointValue := dataPointSplit[1]
+		if dataPointKey == "Alive n" {
+			dataPointKey = "n"
+		}
+
+		switch dataPointKey {
+		case "v":
+			val, err := strconv.ParseFloat(dataPointValue, 64)
+			if err != nil {
+				fail(dataPoint, dataPointKey, dataPointValue, ErrInvalidValue, err)
+				continue
+			}
+			packet.Volts = val
+		case "n":
+			packet.Serial = dataPointValue
+		case "m":
+			val, err := strconv.ParseInt(dataPointValue, 10, 64)
+			if err != nil {
+				fail(dataPoint, dataPointKey, dataPointValue, ErrInvalidValue, err)
+				continue
+			}
+			packet.Seconds = val
+			packet.HasSeconds = true
+		default:
+			dataPointKeySplit := strings.Split(dataPointKey, "_")
+			if len(dataPointKeySplit) != 2 {
+				fail(dataPoint, dataPointKey, dataPointValue, ErrMalformedKey, nil)
+				continue
+			}
+			dataPointType := dataPointKeySplit[0]
+			channel, err := strconv.ParseInt(dataPointKeySplit[1], 10, 64)
+			if err != nil {
+				fail(dataPoint, dataPointKey, dataPointValue, ErrInvalidChannel, err)
+				continue
+			}
+
+			switch dataPointType {
+			case "wh", "p", "a":
+				val, err := strconv.ParseFloat(dataPointValue, 64)
+				if err != nil {
+					fail(dataPoint, dataPointKey, dataPointValue, ErrInvalidValue, err)
+					continue
+				}
+				sample := packet.energy(channel)
+				switch dataPointType {
+				case "wh":
+					sample.WattHours = val
+				case "p":
+					sample.Watts = val
+				case "a":
+					sample.Amps = val
+				}
+			case "t":
+				// "nc" and "x" mark a sensor that is not connected
+				if dataPointValue == "nc" || dataPointValue == "x" {
+					continue
+				}
+				val, err := strconv.ParseFloat(dataPointValue, 64)
+				if err != nil {
+					fail(dataPoint, dataPointKey, dataPointValue, ErrInvalidValue, err)
+					continue
+				}
+				packet.Temperature[channel] = &TemperatureSample{Temperature: val}
+			case "c":
+				val, err := strconv.ParseInt(dataPointValue, 10, 64)
+				if err != nil {
+					fail(dataPoint, dataPointKey, dataPointValue, ErrInvalidValue, err)
+					continue
+				}
+				packet.Pulse[channel] = &PulseSample{Pulses: val}
+			}
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return packet, &ParseError{Fields: fieldErrors}
+	}
+	return packet, nil
+}
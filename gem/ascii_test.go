@@ -0,0 +1,248 @@
+package gem
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+func TestParseASCII(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    *Packet
+		wantErr []error
+	}{
+		{
+			name: "voltage and serial",
+			data: "n=01000123&m=42&v=121.5",
+			want: &Packet{
+				Format:      FormatASCII,
+				Serial:      "01000123",
+				Volts:       121.5,
+				Seconds:     42,
+				HasSeconds:  true,
+				Energy:      map[int64]*EnergySample{},
+				Pulse:       map[int64]*PulseSample{},
+				Temperature: map[int64]*TemperatureSample{},
+			},
+		},
+		{
+			name: "alive prefix",
+			data: "Alive n=01000123&v=120",
+			want: &Packet{
+				Format:      FormatASCII,
+				Serial:      "01000123",
+				Volts:       120,
+				Energy:      map[int64]*EnergySample{},
+				Pulse:       map[int64]*PulseSample{},
+				Temperature: map[int64]*TemperatureSample{},
+			},
+		},
+		{
+			name: "channel fields",
+			data: "n=1&wh_1=10.5&p_1=200&a_1=1.7&wh_2=3&t_1=21.5&t_2=nc&t_3=x&c_4=99",
+			want: &Packet{
+				Format: FormatASCII,
+				Serial: "1",
+				Energy: map[int64]*EnergySample{
+					1: {WattHours: 10.5, Watts: 200, Amps: 1.7},
+					2: {WattHours: 3},
+				},
+				Pulse: map[int64]*PulseSample{
+					4: {Pulses: 99},
+				},
+				Temperature: map[int64]*TemperatureSample{
+					1: {Temperature: 21.5},
+				},
+			},
+		},
+		{
+			name: "trailing newline",
+			data: "n=1&v=120\r\n",
+			want: &Packet{
+				Format:      FormatASCII,
+				Serial:      "1",
+				Volts:       120,
+				Energy:      map[int64]*EnergySample{},
+				Pulse:       map[int64]*PulseSample{},
+				Temperature: map[int64]*TemperatureSample{},
+			},
+		},
+		{
+			name: "unknown channel type is ignored",
+			data: "n=1&zz_1=5",
+			want: &Packet{
+				Format:      FormatASCII,
+				Serial:      "1",
+				Energy:      map[int64]*EnergySample{},
+				Pulse:       map[int64]*PulseSample{},
+				Temperature: map[int64]*TemperatureSample{},
+			},
+		},
+		{
+			name: "bad fields are reported and skipped",
+			data: "n=1&v=abc&garbage&p1=3&wh_x=4&c_1=1.5&p_2=7",
+			want: &Packet{
+				Format: FormatASCII,
+				Serial: "1",
+				Energy: map[int64]*EnergySample{
+					2: {Watts: 7},
+				},
+				Pulse:       map[int64]*PulseSample{},
+				Temperature: map[int64]*TemperatureSample{},
+			},
+			wantErr: []error{ErrInvalidValue, ErrMalformedPair, ErrMalformedKey, ErrInvalidChannel, ErrInvalidValue},
+		},
+		{
+			name:    "empty",
+			data:    " \r\n",
+			wantErr: []error{ErrEmptyPacket},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseASCII([]byte(tt.data))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseASCII() packet = %s, want %s", dump(t, got), dump(t, tt.want))
+			}
+
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("ParseASCII() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("ParseASCII() error = nil, want %v", tt.wantErr)
+			}
+
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				if len(tt.wantErr) != 1 || !errors.Is(err, tt.wantErr[0]) {
+					t.Fatalf("ParseASCII() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if len(parseErr.Fields) != len(tt.wantErr) {
+				t.Fatalf("ParseASCII() got %d field errors (%v), want %d", len(parseErr.Fields), err, len(tt.wantErr))
+			}
+			for i, fieldErr := range parseErr.Fields {
+				if !errors.Is(fieldErr, tt.wantErr[i]) {
+					t.Errorf("field error %d = %v, want %v", i, fieldErr, tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
+
+type goldenResult struct {
+	Packet *Packet
+	Errors []string `json:",omitempty"`
+}
+
+func TestParseASCIIGolden(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "ascii", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Fatal("no captures found in testdata/ascii")
+	}
+
+	for _, capture := range captures {
+		name := strings.TrimSuffix(filepath.Base(capture), ".txt")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := goldenResult{}
+			result.Packet, err = ParseASCII(data)
+			var parseErr *ParseError
+			if errors.As(err, &parseErr) {
+				for _, fieldErr := range parseErr.Fields {
+					result.Errors = append(result.Errors, fieldErr.Error())
+				}
+			} else if err != nil {
+				t.Fatalf("ParseASCII() error = %v", err)
+			}
+
+			got, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(capture, ".txt") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("reading golden file (run with -update to create it): %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("decoded %s does not match %s:\n%s", capture, golden, got)
+			}
+		})
+	}
+}
+
+func FuzzParseASCII(f *testing.F) {
+	captures, _ := filepath.Glob(filepath.Join("testdata", "ascii", "*.txt"))
+	for _, capture := range captures {
+		data, err := os.ReadFile(capture)
+		if err == nil {
+			f.Add(data)
+		}
+	}
+	f.Add([]byte("n=1&v=120&wh_1=1&p_1=2&a_1=3&t_1=4&c_1=5"))
+	f.Add([]byte("Alive n=1&m=1"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := ParseASCII(data)
+		if packet == nil {
+			if !errors.Is(err, ErrEmptyPacket) {
+				t.Fatalf("nil packet with error %v", err)
+			}
+			return
+		}
+		var parseErr *ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			t.Fatalf("unexpected error type %T: %v", err, err)
+		}
+		if parseErr != nil && len(parseErr.Fields) == 0 {
+			t.Fatal("ParseError without field errors")
+		}
+		for channel, sample := range packet.Energy {
+			if sample == nil {
+				t.Fatalf("nil energy sample for channel %d", channel)
+			}
+		}
+	})
+}
+
+func dump(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
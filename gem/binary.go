@@ -0,0 +1,418 @@
+package gem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrShortPacket is returned when a binary frame is shorter than its layout.
+	ErrShortPacket = errors.New("short packet")
+	// ErrBadHeader is returned when a binary frame does not start with a known header.
+	ErrBadHeader = errors.New("bad packet header")
+	// ErrBadFooter is returned when a binary frame does not end with the footer.
+	ErrBadFooter = errors.New("bad packet footer")
+	// ErrBadChecksum is returned when the checksum byte of a binary frame does not match.
+	ErrBadChecksum = errors.New("bad packet checksum")
+)
+
+// Format identifies one of the packet formats a GEM can be configured to emit.
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatASCII
+	FormatGEM48PTBinary
+	FormatGEM48PDBinary
+	FormatGEM32PTBinary
+	FormatGEM32PDBinary
+	FormatECMBinary
+)
+
+func (f Format) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatASCII:
+		return "ascii"
+	case FormatGEM48PTBinary:
+		return "GEM48PTBinary"
+	case FormatGEM48PDBinary:
+		return "GEM48PDBinary"
+	case FormatGEM32PTBinary:
+		return "GEM32PTBinary"
+	case FormatGEM32PDBinary:
+		return "GEM32PDBinary"
+	case FormatECMBinary:
+		return "ECMBinary"
+	}
+	return "unknown"
+}
+
+// Binary reports whether f is one of the binary packet formats.
+func (f Format) Binary() bool {
+	return f >= FormatGEM48PTBinary
+}
+
+const (
+	binaryPacketID  = 0x05
+	pulseChannels   = 4
+	tempChannels    = 8
+	binaryOverhead  = 3 + 2 + 1 // header, footer, checksum
+	timestampLength = 6
+)
+
+var (
+	binaryHeader = []byte{0xfe, 0xff, binaryPacketID}
+	binaryFooter = []byte{0xff, 0xfe}
+)
+
+// binaryLayout describes one of the binary packet variants. All variants
+// share the same header and field order and are told apart by length,
+// shortest first so SplitBinary never waits longer than it has to.
+type binaryLayout struct {
+	format    Format
+	channels  int
+	timestamp bool
+}
+
+var binaryLayouts = []binaryLayout{
+	{format: FormatGEM32PTBinary, channels: 32},
+	{format: FormatGEM32PDBinary, channels: 32, timestamp: true},
+	{format: FormatGEM48PTBinary, channels: 48},
+	{format: FormatGEM48PDBinary, channels: 48, timestamp: true},
+}
+
+// length returns the total frame length including header, footer and checksum.
+func (l binaryLayout) length() int {
+	n := 2 + // voltage
+		l.channels*5*2 + // absolute and polarized watt-seconds
+		2 + 1 + 1 + // serial, reserved, device id
+		l.channels*2 + // currents
+		3 + // seconds
+		pulseChannels*3 +
+		tempChannels*2 +
+		binaryOverhead
+	if l.timestamp {
+		n += timestampLength
+	}
+	return n
+}
+
+func layoutForLength(n int) (binaryLayout, bool) {
+	for _, layout := range binaryLayouts {
+		if layout.length() == n {
+			return layout, true
+		}
+	}
+	return binaryLayout{}, false
+}
+
+// Detect guesses the packet format from the first bytes read from a device.
+// It returns false when there is not enough data to decide. Any binary
+// stream is reported as FormatGEM48PTBinary; the exact variant is only
+// known once a whole frame has been read.
+func Detect(b []byte) (Format, bool) {
+	if len(b) == 0 {
+		return FormatUnknown, false
+	}
+	if bytes.Contains(b, binaryHeader) {
+		return FormatGEM48PTBinary, true
+	}
+	for _, c := range b {
+		if c != '\r' && c != '\n' && c != '\t' && (c < 0x20 || c > 0x7e) {
+			return FormatGEM48PTBinary, true
+		}
+	}
+	return FormatASCII, true
+}
+
+// SplitBinary is a bufio.SplitFunc that frames binary GEM packets. Bytes
+// that can not be the start of a frame are discarded so the scanner
+// resynchronises after corruption. Checksums are left to ParseBinary so
+// that corrupt frames are reported rather than silently skipped.
+func SplitBinary(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return splitFrames(data, atEOF, binaryHeader, binaryLengths)
+}
+
+var binaryLengths = func() []int {
+	lengths := make([]int, len(binaryLayouts))
+	for i, layout := range binaryLayouts {
+		lengths[i] = layout.length()
+	}
+	return lengths
+}()
+
+// splitFrames finds the first frame starting with header whose footer sits
+// at one of lengths, which must be sorted shortest first.
+func splitFrames(data []byte, atEOF bool, header []byte, lengths []int) (advance int, token []byte, err error) {
+	// bufio.Scanner stops at EOF as soon as no token is returned, so when
+	// discarding bytes at EOF keep looking for a frame in the remainder.
+	skip := func(n int) (int, []byte, error) {
+		if !atEOF || n >= len(data) {
+			return n, nil, nil
+		}
+		advance, token, err := splitFrames(data[n:], atEOF, header, lengths)
+		if token == nil {
+			return len(data), nil, err
+		}
+		return n + advance, token, err
+	}
+
+	start := bytes.Index(data, header)
+	if start < 0 {
+		// keep a possible partial header at the end of the buffer
+		keep := len(header) - 1
+		if atEOF {
+			return len(data), nil, nil
+		}
+		if len(data) <= keep {
+			return 0, nil, nil
+		}
+		return len(data) - keep, nil, nil
+	}
+	if start > 0 {
+		return skip(start)
+	}
+
+	complete := true
+	var candidate []byte
+	for _, n := range lengths {
+		if len(data) < n {
+			complete = false
+			continue
+		}
+		if !bytes.Equal(data[n-3:n-1], binaryFooter) {
+			continue
+		}
+		if validChecksum(data[:n]) {
+			return n, data[:n], nil
+		}
+		if candidate == nil {
+			candidate = data[:n]
+		}
+	}
+
+	if complete || atEOF {
+		if candidate != nil {
+			// hand the corrupt frame to the parser so it gets reported
+			return len(candidate), candidate, nil
+		}
+		// a header without a footer at any known length; skip it
+		return skip(1)
+	}
+	return 0, nil, nil
+}
+
+func checksum(frame []byte) byte {
+	var sum byte
+	for _, c := range frame[:len(frame)-1] {
+		sum += c
+	}
+	return sum
+}
+
+func validChecksum(frame []byte) bool {
+	return checksum(frame) == frame[len(frame)-1]
+}
+
+// ParseBinary decodes a single binary frame as produced by SplitBinary.
+// Watts are left at zero because the binary formats only carry counters;
+// use a BinaryDecoder to derive them from consecutive packets.
+func ParseBinary(frame []byte) (*Packet, error) {
+	if len(frame) < len(binaryHeader) || !bytes.Equal(frame[:len(binaryHeader)], binaryHeader) {
+		return nil, ErrBadHeader
+	}
+	layout, ok := layoutForLength(len(frame))
+	if !ok {
+		return nil, fmt.Errorf("%w: %d bytes", ErrShortPacket, len(frame))
+	}
+	if !bytes.Equal(frame[len(frame)-3:len(frame)-1], binaryFooter) {
+		return nil, ErrBadFooter
+	}
+	if sum := checksum(frame); sum != frame[len(frame)-1] {
+		return nil, fmt.Errorf("%w: got 0x%02x, want 0x%02x", ErrBadChecksum, frame[len(frame)-1], sum)
+	}
+
+	packet := newPacket()
+	packet.Format = layout.format
+
+	r := &byteReader{data: frame[len(binaryHeader):]}
+	packet.Volts = float64(r.uintBE(2)) / 10
+
+	absolute := make([]uint64, layout.channels)
+	for i := range absolute {
+		absolute[i] = r.uintLE(5)
+	}
+	polarized := make([]uint64, layout.channels)
+	for i := range polarized {
+		polarized[i] = r.uintLE(5)
+	}
+
+	serial := r.uintBE(2)
+	r.skip(1)
+	deviceID := r.uintBE(1)
+	packet.Serial = fmt.Sprintf("%03d%05d", deviceID, serial)
+
+	for i := 0; i < layout.channels; i++ {
+		channel := int64(i + 1)
+		packet.Energy[channel] = &EnergySample{
+			WattHours:            float64(absolute[i]) / 3600,
+			Amps:                 float64(r.uintLE(2)) / 100,
+			AbsoluteWattSeconds:  absolute[i],
+			PolarizedWattSeconds: polarized[i],
+		}
+	}
+
+	packet.Seconds = int64(r.uintLE(3))
+	packet.HasSeconds = true
+
+	for i := 0; i < pulseChannels; i++ {
+		packet.Pulse[int64(i+1)] = &PulseSample{Pulses: int64(r.uintLE(3))}
+	}
+
+	for i := 0; i < tempChannels; i++ {
+		raw := r.uintLE(2)
+		// the high bit marks a negative reading, 0xffff an unconnected sensor
+		if raw == 0xffff {
+			continue
+		}
+		temperature := float64(raw&0x7fff) / 2
+		if raw&0x8000 != 0 {
+			temperature = -temperature
+		}
+		packet.Temperature[int64(i+1)] = &TemperatureSample{Temperature: temperature}
+	}
+
+	if layout.timestamp {
+		ts := r.bytes(timestampLength)
+		packet.Time = time.Date(2000+int(ts[0]), time.Month(ts[1]), int(ts[2]), int(ts[3]), int(ts[4]), int(ts[5]), 0, time.UTC)
+	}
+
+	return packet, nil
+}
+
+const (
+	secondsCounterModulo     = 1 << 24
+	wattSecondsCounterModulo = 1 << 40
+)
+
+// BinaryDecoder decodes binary frames and derives per-channel watts from
+// the difference between consecutive packets from the same device.
+type BinaryDecoder struct {
+	// Model selects the ECM packet layout when set to ModelECM1240 or
+	// ModelECM1220; otherwise frames are decoded as GEM packets.
+	Model string
+
+	previous map[string]*Packet
+}
+
+func NewBinaryDecoder() *BinaryDecoder {
+	return &BinaryDecoder{
+		previous: make(map[string]*Packet),
+	}
+}
+
+func NewECMDecoder(model string) *BinaryDecoder {
+	return &BinaryDecoder{
+		Model:    model,
+		previous: make(map[string]*Packet),
+	}
+}
+
+// Decode parses frame and fills in Watts using the previous packet seen
+// from the same serial. Watts are net of energy exported, and so negative
+// for a channel exporting more than it imports, except on ECM auxiliary
+// channels which only have an absolute counter. The first packet from a
+// device has zero watts.
+func (d *BinaryDecoder) Decode(frame []byte) (*Packet, error) {
+	var packet *Packet
+	var err error
+	switch d.Model {
+	case ModelECM1240, ModelECM1220:
+		packet, err = ParseECM(frame, d.Model)
+	default:
+		packet, err = ParseBinary(frame)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	previous, ok := d.previous[packet.Serial]
+	d.previous[packet.Serial] = packet
+	if !ok {
+		return packet, nil
+	}
+
+	elapsed := (packet.Seconds - previous.Seconds + secondsCounterModulo) % secondsCounterModulo
+	if elapsed == 0 {
+		return packet, nil
+	}
+
+	for channel, sample := range packet.Energy {
+		before, ok := previous.Energy[channel]
+		if !ok {
+			continue
+		}
+		modulo := counterModulo(packet.Format, channel)
+		absolute := (sample.AbsoluteWattSeconds + modulo - before.AbsoluteWattSeconds) % modulo
+		if !polarized(packet.Format, channel) {
+			sample.Watts = float64(absolute) / float64(elapsed)
+			continue
+		}
+		// the polarized counter only counts energy flowing in the
+		// positive direction, so what the absolute counter counted beyond
+		// it flowed the other way
+		positive := (sample.PolarizedWattSeconds + modulo - before.PolarizedWattSeconds) % modulo
+		sample.Watts = (2*float64(positive) - float64(absolute)) / float64(elapsed)
+	}
+
+	return packet, nil
+}
+
+func counterModulo(format Format, channel int64) uint64 {
+	if format == FormatECMBinary && channel > ecmCTChannels {
+		return ecmAuxCounterModulo
+	}
+	return wattSecondsCounterModulo
+}
+
+// polarized reports whether channel has a polarized watt-seconds counter.
+func polarized(format Format, channel int64) bool {
+	return !(format == FormatECMBinary && channel > ecmCTChannels)
+}
+
+type byteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *byteReader) skip(n int) {
+	r.pos += n
+}
+
+func (r *byteReader) uintLE(n int) uint64 {
+	var v uint64
+	for i, c := range r.bytes(n) {
+		v |= uint64(c) << (8 * i)
+	}
+	return v
+}
+
+func (r *byteReader) uintBE(n int) uint64 {
+	var v uint64
+	for _, c := range r.bytes(n) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
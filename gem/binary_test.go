@@ -0,0 +1,296 @@
+package gem
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testFrame struct {
+	layout      binaryLayout
+	volts       uint16
+	serial      uint16
+	deviceID    byte
+	absolute    map[int]uint64
+	polarized   map[int]uint64
+	centiAmps   map[int]uint16
+	seconds     uint32
+	pulses      [pulseChannels]uint32
+	temperature [tempChannels]uint16
+	timestamp   [timestampLength]byte
+}
+
+func putLE(b *bytes.Buffer, v uint64, n int) {
+	for i := 0; i < n; i++ {
+		b.WriteByte(byte(v >> (8 * i)))
+	}
+}
+
+func (f testFrame) bytes() []byte {
+	b := &bytes.Buffer{}
+	b.Write(binaryHeader)
+	b.WriteByte(byte(f.volts >> 8))
+	b.WriteByte(byte(f.volts))
+	for i := 0; i < f.layout.channels; i++ {
+		putLE(b, f.absolute[i+1], 5)
+	}
+	for i := 0; i < f.layout.channels; i++ {
+		putLE(b, f.polarized[i+1], 5)
+	}
+	b.WriteByte(byte(f.serial >> 8))
+	b.WriteByte(byte(f.serial))
+	b.WriteByte(0)
+	b.WriteByte(f.deviceID)
+	for i := 0; i < f.layout.channels; i++ {
+		putLE(b, uint64(f.centiAmps[i+1]), 2)
+	}
+	putLE(b, uint64(f.seconds), 3)
+	for _, pulses := range f.pulses {
+		putLE(b, uint64(pulses), 3)
+	}
+	for _, temperature := range f.temperature {
+		putLE(b, uint64(temperature), 2)
+	}
+	if f.layout.timestamp {
+		b.Write(f.timestamp[:])
+	}
+	b.Write(binaryFooter)
+	frame := append(b.Bytes(), 0)
+	frame[len(frame)-1] = checksum(frame)
+	return frame
+}
+
+func newTestFrame(layout binaryLayout) testFrame {
+	return testFrame{
+		layout:      layout,
+		volts:       1214,
+		serial:      123,
+		deviceID:    10,
+		absolute:    map[int]uint64{1: 36000, 2: 7200},
+		polarized:   map[int]uint64{1: 3600},
+		centiAmps:   map[int]uint16{1: 1250},
+		seconds:     500,
+		pulses:      [pulseChannels]uint32{7, 0, 0, 1 << 20},
+		temperature: [tempChannels]uint16{43, 0x8000 | 5, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff},
+		timestamp:   [timestampLength]byte{23, 7, 27, 12, 30, 45},
+	}
+}
+
+func TestBinaryLayoutLengths(t *testing.T) {
+	want := map[Format]int{
+		FormatGEM48PTBinary: 619,
+		FormatGEM48PDBinary: 625,
+		FormatGEM32PTBinary: 427,
+		FormatGEM32PDBinary: 433,
+	}
+	for _, layout := range binaryLayouts {
+		if got := layout.length(); got != want[layout.format] {
+			t.Errorf("%s length = %d, want %d", layout.format, got, want[layout.format])
+		}
+	}
+}
+
+func TestParseBinary(t *testing.T) {
+	for _, layout := range binaryLayouts {
+		t.Run(layout.format.String(), func(t *testing.T) {
+			packet, err := ParseBinary(newTestFrame(layout).bytes())
+			if err != nil {
+				t.Fatalf("ParseBinary() error = %v", err)
+			}
+			if packet.Format != layout.format {
+				t.Errorf("Format = %s, want %s", packet.Format, layout.format)
+			}
+			if packet.Serial != "01000123" {
+				t.Errorf("Serial = %q, want %q", packet.Serial, "01000123")
+			}
+			if packet.Volts != 121.4 {
+				t.Errorf("Volts = %v, want 121.4", packet.Volts)
+			}
+			if !packet.HasSeconds || packet.Seconds != 500 {
+				t.Errorf("Seconds = %d (%v), want 500", packet.Seconds, packet.HasSeconds)
+			}
+			if len(packet.Energy) != layout.channels {
+				t.Errorf("got %d energy channels, want %d", len(packet.Energy), layout.channels)
+			}
+			want := &EnergySample{WattHours: 10, Amps: 12.5, AbsoluteWattSeconds: 36000, PolarizedWattSeconds: 3600}
+			if got := packet.Energy[1]; *got != *want {
+				t.Errorf("Energy[1] = %+v, want %+v", got, want)
+			}
+			if got := packet.Pulse[4].Pulses; got != 1<<20 {
+				t.Errorf("Pulse[4] = %d, want %d", got, 1<<20)
+			}
+			if got := packet.Temperature[1].Temperature; got != 21.5 {
+				t.Errorf("Temperature[1] = %v, want 21.5", got)
+			}
+			if got := packet.Temperature[2].Temperature; got != -2.5 {
+				t.Errorf("Temperature[2] = %v, want -2.5", got)
+			}
+			if _, ok := packet.Temperature[3]; ok {
+				t.Error("unconnected temperature sensor was decoded")
+			}
+			wantTime := time.Time{}
+			if layout.timestamp {
+				wantTime = time.Date(2023, 7, 27, 12, 30, 45, 0, time.UTC)
+			}
+			if !packet.Time.Equal(wantTime) {
+				t.Errorf("Time = %v, want %v", packet.Time, wantTime)
+			}
+		})
+	}
+}
+
+func TestBinaryDecoderWatts(t *testing.T) {
+	layout := binaryLayouts[0]
+	first := newTestFrame(layout)
+	first.absolute = map[int]uint64{1: 36000, 2: 7200, 3: wattSecondsCounterModulo - 500}
+	first.polarized = map[int]uint64{1: 3600, 2: 7200, 3: wattSecondsCounterModulo - 100}
+
+	second := newTestFrame(layout)
+	second.seconds = first.seconds + 10
+	second.absolute = map[int]uint64{
+		// importing 300 W
+		1: 36000 + 10*300,
+		// exporting 200 W
+		2: 7200 + 10*200,
+		// both counters wrap: 40 W imported and 60 W exported
+		3: 500,
+	}
+	second.polarized = map[int]uint64{1: 3600 + 10*300, 2: 7200, 3: 300}
+
+	decoder := NewBinaryDecoder()
+	if _, err := decoder.Decode(first.bytes()); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	packet, err := decoder.Decode(second.bytes())
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	for channel, want := range map[int64]float64{1: 300, 2: -200, 3: -20, 4: 0} {
+		if got := packet.Energy[channel].Watts; got != want {
+			t.Errorf("channel %d Watts = %v, want %v", channel, got, want)
+		}
+	}
+}
+
+func TestParseBinaryErrors(t *testing.T) {
+	valid := newTestFrame(binaryLayouts[0]).bytes()
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"empty", nil, ErrBadHeader},
+		{"bad header", corrupt(func(b []byte) []byte { b[2] = 0x01; return b }), ErrBadHeader},
+		{"short", valid[:100], ErrShortPacket},
+		{"bad footer", corrupt(func(b []byte) []byte { b[len(b)-2] = 0; return b }), ErrBadFooter},
+		{"bad checksum", corrupt(func(b []byte) []byte { b[10]++; return b }), ErrBadChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, err := ParseBinary(tt.frame)
+			if packet != nil || !errors.Is(err, tt.want) {
+				t.Errorf("ParseBinary() = %v, %v, want %v", packet, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitBinary(t *testing.T) {
+	first := newTestFrame(binaryLayouts[2])
+	second := first
+	second.seconds += 2
+	second.absolute = map[int]uint64{1: 36000 + 2*1500, 2: 7200}
+	second.polarized = map[int]uint64{1: 3600 + 2*1500}
+
+	bad := newTestFrame(binaryLayouts[2]).bytes()
+	bad[20]++
+
+	stream := &bytes.Buffer{}
+	stream.WriteString("garbage\xfe\xff")
+	stream.Write(first.bytes())
+	stream.Write(bad)
+	stream.Write([]byte{0xfe, 0xff, 0x05, 0x00})
+	stream.Write(second.bytes())
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 4096), 4096)
+	scanner.Split(SplitBinary)
+
+	decoder := NewBinaryDecoder()
+	var packets []*Packet
+	var errs []error
+	for scanner.Scan() {
+		packet, err := decoder.Decode(scanner.Bytes())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		packets = append(packets, packet)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("scanner error = %v", err)
+	}
+
+	if len(packets) != 2 {
+		t.Fatalf("decoded %d packets, want 2", len(packets))
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrBadChecksum) {
+		t.Errorf("errors = %v, want one %v", errs, ErrBadChecksum)
+	}
+	if got := packets[0].Energy[1].Watts; got != 0 {
+		t.Errorf("first packet Watts = %v, want 0", got)
+	}
+	if got := packets[1].Energy[1].Watts; got != 1500 {
+		t.Errorf("second packet Watts = %v, want 1500", got)
+	}
+	if got := packets[1].Energy[2].Watts; got != 0 {
+		t.Errorf("second packet channel 2 Watts = %v, want 0", got)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want Format
+		ok   bool
+	}{
+		{nil, FormatUnknown, false},
+		{[]byte("n=01000123&m=1\r\n"), FormatASCII, true},
+		{newTestFrame(binaryLayouts[0]).bytes()[:8], FormatGEM48PTBinary, true},
+		{[]byte{0x00, 0x01}, FormatGEM48PTBinary, true},
+	}
+	for _, tt := range tests {
+		got, ok := Detect(tt.data)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Detect(%q) = %s, %v, want %s, %v", tt.data, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func FuzzSplitBinary(f *testing.F) {
+	f.Add(newTestFrame(binaryLayouts[0]).bytes())
+	f.Add(newTestFrame(binaryLayouts[1]).bytes())
+	f.Add(append([]byte("\xfe\xff\x05junk"), newTestFrame(binaryLayouts[3]).bytes()...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 1024), 1024)
+		scanner.Split(SplitBinary)
+		decoder := NewBinaryDecoder()
+		for scanner.Scan() {
+			packet, err := decoder.Decode(scanner.Bytes())
+			if (packet == nil) == (err == nil) {
+				t.Fatalf("Decode() = %v, %v", packet, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("scanner error = %v", err)
+		}
+	})
+}
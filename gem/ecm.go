@@ -0,0 +1,94 @@
+package gem
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	ModelECM1240 = "ECM-1240"
+	ModelECM1220 = "ECM-1220"
+)
+
+const (
+	ecmPacketID         = 0x03
+	ecmLength           = 65
+	ecmCTChannels       = 2
+	ecmAuxChannels      = 5
+	ecmAuxCounterModulo = 1 << 32
+)
+
+var ecmHeader = []byte{0xfe, 0xff, ecmPacketID}
+
+// SplitECM is a bufio.SplitFunc that frames ECM-1240/ECM-1220 binary
+// packets, resynchronising the same way SplitBinary does.
+func SplitECM(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return splitFrames(data, atEOF, ecmHeader, []int{ecmLength})
+}
+
+// ParseECM decodes a single ECM-1240 or ECM-1220 binary frame. Channels 1
+// and 2 are the CT inputs and, on the ECM-1240, channels 3 to 7 are the
+// auxiliary inputs. As with ParseBinary, watts are left at zero.
+func ParseECM(frame []byte, model string) (*Packet, error) {
+	if len(frame) < len(ecmHeader) || !bytes.Equal(frame[:len(ecmHeader)], ecmHeader) {
+		return nil, ErrBadHeader
+	}
+	if len(frame) != ecmLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrShortPacket, len(frame))
+	}
+	if !bytes.Equal(frame[len(frame)-3:len(frame)-1], binaryFooter) {
+		return nil, ErrBadFooter
+	}
+	if sum := checksum(frame); sum != frame[len(frame)-1] {
+		return nil, fmt.Errorf("%w: got 0x%02x, want 0x%02x", ErrBadChecksum, frame[len(frame)-1], sum)
+	}
+
+	packet := newPacket()
+	packet.Format = FormatECMBinary
+	packet.Model = model
+
+	r := &byteReader{data: frame[len(ecmHeader):]}
+	packet.Volts = float64(r.uintBE(2)) / 10
+
+	var absolute, polarized [ecmCTChannels]uint64
+	for i := range absolute {
+		absolute[i] = r.uintLE(5)
+	}
+	for i := range polarized {
+		polarized[i] = r.uintLE(5)
+	}
+	r.skip(4)
+
+	serial := r.uintBE(2)
+	r.skip(1) // reset flag
+	deviceID := r.uintBE(1)
+	packet.Serial = fmt.Sprintf("%03d%05d", deviceID, serial)
+
+	for i := 0; i < ecmCTChannels; i++ {
+		packet.Energy[int64(i+1)] = &EnergySample{
+			WattHours:            float64(absolute[i]) / 3600,
+			Amps:                 float64(r.uintLE(2)) / 100,
+			AbsoluteWattSeconds:  absolute[i],
+			PolarizedWattSeconds: polarized[i],
+		}
+	}
+
+	packet.Seconds = int64(r.uintLE(3))
+	packet.HasSeconds = true
+
+	for i := 0; i < ecmAuxChannels; i++ {
+		wattSeconds := r.uintLE(4)
+		if model == ModelECM1220 {
+			// the ECM-1220 has no auxiliary inputs
+			continue
+		}
+		packet.Energy[int64(ecmCTChannels+i+1)] = &EnergySample{
+			WattHours:           float64(wattSeconds) / 3600,
+			AbsoluteWattSeconds: wattSeconds,
+		}
+	}
+
+	packet.DCVolts = float64(r.uintLE(2)) / 100
+
+	return packet, nil
+}
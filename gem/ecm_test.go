@@ -0,0 +1,158 @@
+package gem
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type testECMFrame struct {
+	volts       uint16
+	serial      uint16
+	deviceID    byte
+	absolute    [ecmCTChannels]uint64
+	polarized   [ecmCTChannels]uint64
+	centiAmps   [ecmCTChannels]uint16
+	seconds     uint32
+	aux         [ecmAuxChannels]uint32
+	centiDCVolt uint16
+}
+
+func (f testECMFrame) bytes() []byte {
+	b := &bytes.Buffer{}
+	b.Write(ecmHeader)
+	b.WriteByte(byte(f.volts >> 8))
+	b.WriteByte(byte(f.volts))
+	for _, v := range f.absolute {
+		putLE(b, v, 5)
+	}
+	for _, v := range f.polarized {
+		putLE(b, v, 5)
+	}
+	b.Write(make([]byte, 4))
+	b.WriteByte(byte(f.serial >> 8))
+	b.WriteByte(byte(f.serial))
+	b.WriteByte(0)
+	b.WriteByte(f.deviceID)
+	for _, v := range f.centiAmps {
+		putLE(b, uint64(v), 2)
+	}
+	putLE(b, uint64(f.seconds), 3)
+	for _, v := range f.aux {
+		putLE(b, uint64(v), 4)
+	}
+	putLE(b, uint64(f.centiDCVolt), 2)
+	b.Write(binaryFooter)
+	frame := append(b.Bytes(), 0)
+	frame[len(frame)-1] = checksum(frame)
+	return frame
+}
+
+func newTestECMFrame() testECMFrame {
+	return testECMFrame{
+		volts:       1203,
+		serial:      4321,
+		deviceID:    3,
+		absolute:    [ecmCTChannels]uint64{7200, 3600},
+		polarized:   [ecmCTChannels]uint64{3600, 0},
+		centiAmps:   [ecmCTChannels]uint16{510, 20},
+		seconds:     1000,
+		aux:         [ecmAuxChannels]uint32{36000, 0, 0, 0, 1<<32 - 100},
+		centiDCVolt: 1225,
+	}
+}
+
+func TestParseECM(t *testing.T) {
+	tests := []struct {
+		model    string
+		channels int
+	}{
+		{ModelECM1240, ecmCTChannels + ecmAuxChannels},
+		{ModelECM1220, ecmCTChannels},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			frame := newTestECMFrame().bytes()
+			if len(frame) != ecmLength {
+				t.Fatalf("test frame is %d bytes, want %d", len(frame), ecmLength)
+			}
+
+			packet, err := ParseECM(frame, tt.model)
+			if err != nil {
+				t.Fatalf("ParseECM() error = %v", err)
+			}
+			if packet.Model != tt.model || packet.Format != FormatECMBinary {
+				t.Errorf("Model, Format = %q, %s", packet.Model, packet.Format)
+			}
+			if packet.Serial != "00304321" {
+				t.Errorf("Serial = %q, want %q", packet.Serial, "00304321")
+			}
+			if packet.Volts != 120.3 || packet.DCVolts != 12.25 {
+				t.Errorf("Volts, DCVolts = %v, %v, want 120.3, 12.25", packet.Volts, packet.DCVolts)
+			}
+			if packet.Seconds != 1000 {
+				t.Errorf("Seconds = %d, want 1000", packet.Seconds)
+			}
+			if len(packet.Energy) != tt.channels {
+				t.Errorf("got %d energy channels, want %d", len(packet.Energy), tt.channels)
+			}
+			want := &EnergySample{WattHours: 2, Amps: 5.1, AbsoluteWattSeconds: 7200, PolarizedWattSeconds: 3600}
+			if got := packet.Energy[1]; *got != *want {
+				t.Errorf("Energy[1] = %+v, want %+v", got, want)
+			}
+			if aux, ok := packet.Energy[3]; ok && aux.WattHours != 10 {
+				t.Errorf("Energy[3].WattHours = %v, want 10", aux.WattHours)
+			}
+		})
+	}
+
+	frame := newTestECMFrame().bytes()
+	frame[5]++
+	if _, err := ParseECM(frame, ModelECM1240); !errors.Is(err, ErrBadChecksum) {
+		t.Errorf("ParseECM() corrupt frame error = %v, want %v", err, ErrBadChecksum)
+	}
+}
+
+func TestECMDecoderWatts(t *testing.T) {
+	first := newTestECMFrame()
+	second := first
+	second.seconds += 10
+	second.absolute[0] += 10 * 250
+	second.polarized[0] += 10 * 250
+	// channel 2 exports 100 W
+	second.absolute[1] += 10 * 100
+	// aux channel 5 wraps around its 4 byte counter
+	second.aux[4] = 900
+
+	stream := &bytes.Buffer{}
+	stream.Write(first.bytes())
+	stream.Write([]byte{0x00, 0xfe})
+	stream.Write(second.bytes())
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Split(SplitECM)
+	decoder := NewECMDecoder(ModelECM1240)
+
+	var packets []*Packet
+	for scanner.Scan() {
+		packet, err := decoder.Decode(scanner.Bytes())
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		packets = append(packets, packet)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("decoded %d packets, want 2", len(packets))
+	}
+
+	if got := packets[1].Energy[1].Watts; got != 250 {
+		t.Errorf("channel 1 Watts = %v, want 250", got)
+	}
+	if got := packets[1].Energy[2].Watts; got != -100 {
+		t.Errorf("channel 2 Watts = %v, want -100", got)
+	}
+	if got := packets[1].Energy[7].Watts; got != 100 {
+		t.Errorf("channel 7 Watts = %v, want 100", got)
+	}
+}
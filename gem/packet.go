@@ -0,0 +1,122 @@
+// Package gem decodes the packet formats emitted by Brultech GreenEye
+// Monitor (GEM) devices.
+package gem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrEmptyPacket is returned when a packet contains no data at all.
+	ErrEmptyPacket = errors.New("empty packet")
+	// ErrMalformedPair is used when a field is not of the form key=value.
+	ErrMalformedPair = errors.New("malformed key=value pair")
+	// ErrMalformedKey is used when a channel key is not of the form type_channel.
+	ErrMalformedKey = errors.New("malformed channel key")
+	// ErrInvalidChannel is used when the channel part of a key is not a number.
+	ErrInvalidChannel = errors.New("invalid channel number")
+	// ErrInvalidValue is used when a value can not be parsed as a number.
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+type EnergySample struct {
+	WattHours float64
+	Watts     float64
+	Amps      float64
+
+	// AbsoluteWattSeconds and PolarizedWattSeconds are the raw counters
+	// carried by the binary formats; they are zero for ASCII packets.
+	AbsoluteWattSeconds  uint64
+	PolarizedWattSeconds uint64
+}
+
+type PulseSample struct {
+	Pulses int64
+}
+
+type TemperatureSample struct {
+	Temperature float64
+}
+
+// Packet is a single decoded GEM packet.
+type Packet struct {
+	Format Format
+	// Model is the device model for devices other than the GEM, which
+	// leaves it empty.
+	Model       string
+	Serial      string
+	Volts       float64
+	Seconds     int64
+	HasSeconds  bool
+	Energy      map[int64]*EnergySample
+	Pulse       map[int64]*PulseSample
+	Temperature map[int64]*TemperatureSample
+
+	// Time is the device clock, only set by formats that carry it.
+	Time time.Time
+	// DCVolts is the DC input voltage reported by ECM devices.
+	DCVolts float64
+}
+
+func newPacket() *Packet {
+	return &Packet{
+		Energy:      make(map[int64]*EnergySample),
+		Pulse:       make(map[int64]*PulseSample),
+		Temperature: make(map[int64]*TemperatureSample),
+	}
+}
+
+func (p *Packet) energy(channel int64) *EnergySample {
+	sample, ok := p.Energy[channel]
+	if !ok {
+		sample = &EnergySample{}
+		p.Energy[channel] = sample
+	}
+	return sample
+}
+
+// FieldError describes a single field of a packet that could not be decoded.
+type FieldError struct {
+	Pair  string
+	Key   string
+	Value string
+	Err   error
+	Cause error
+}
+
+func (e *FieldError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %q: %s", e.Err, e.Pair, e.Cause)
+	}
+	return fmt.Sprintf("%s: %q", e.Err, e.Pair)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned when one or more fields of a packet could not be
+// decoded. The packet returned alongside it still holds every field that
+// did decode.
+type ParseError struct {
+	Fields []*FieldError
+}
+
+func (e *ParseError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		msgs[i] = field.Error()
+	}
+	return fmt.Sprintf("%d bad fields: %s", len(e.Fields), strings.Join(msgs, "; "))
+}
+
+func (e *ParseError) Unwrap() []error {
+	errs := make([]error, len(e.Fields))
+	for i, field := range e.Fields {
+		errs[i] = field
+	}
+	return errs
+}
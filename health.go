@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/influxbg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxBacklog   = 10000
+	defaultMaxWriteAge  = 5 * time.Minute
+	defaultStallTimeout = 5 * time.Minute
+)
+
+// HealthConfig configures the HTTP listener serving /healthz and /readyz
+// for Kubernetes probes.
+type HealthConfig struct {
+	Address string `json:"address"`
+	// MaxBacklog is how many points may wait to be written to InfluxDB
+	// before brul2influx reports itself not ready, defaultMaxBacklog if
+	// zero.
+	MaxBacklog int `json:"max_backlog"`
+	// MaxWriteAge is how long points may wait without a successful write
+	// before brul2influx reports itself not ready, defaultMaxWriteAge if
+	// zero.
+	MaxWriteAge Duration `json:"max_write_age"`
+	// StallTimeout is how long the writer's loop may go without running
+	// before brul2influx reports itself not live, defaultStallTimeout if
+	// zero.
+	StallTimeout Duration `json:"stall_timeout"`
+}
+
+func (h *HealthConfig) maxBacklog() int {
+	if h.MaxBacklog <= 0 {
+		return defaultMaxBacklog
+	}
+	return h.MaxBacklog
+}
+
+func (h *HealthConfig) maxWriteAge() time.Duration {
+	if h.MaxWriteAge <= 0 {
+		return defaultMaxWriteAge
+	}
+	return time.Duration(h.MaxWriteAge)
+}
+
+func (h *HealthConfig) stallTimeout() time.Duration {
+	if h.StallTimeout <= 0 {
+		return defaultStallTimeout
+	}
+	return time.Duration(h.StallTimeout)
+}
+
+// Health checks the collectors for configured hosts, as returned by
+// collectors when checked, and the InfluxDB writer, which may be nil.
+// leading, if not nil, reports whether this replica is the leader; only
+// the leader is ready, as only it accepts packets on the listener and
+// HTTP ingest.
+type Health struct {
+	config     *HealthConfig
+	collectors func() []*Collector
+	writer     *influxbg.InfluxBGWriter
+	leading    func() bool
+	now        func() time.Time
+}
+
+func NewHealth(config *HealthConfig, collectors func() []*Collector, writer *influxbg.InfluxBGWriter, leading func() bool) *Health {
+	return &Health{
+		config:     config,
+		collectors: collectors,
+		writer:     writer,
+		leading:    leading,
+		now:        time.Now,
+	}
+}
+
+// live returns the reasons brul2influx needs restarting: a collector or a
+// writer that is stuck. A connected collector should have reconnected
+// once its inactivity timeout passed without data, so one that has gone
+// twice that long without a packet is wedged.
+func (h *Health) live() []string {
+	var problems []string
+	now := h.now()
+	for _, collector := range h.collectors() {
+		status := collector.Status()
+		timeout := collector.host.inactivityTimeout()
+		if status.State != StateConnected || timeout <= 0 {
+			continue
+		}
+		last := status.Since
+		if status.LastPacket.After(last) {
+			last = status.LastPacket
+		}
+		if quiet := now.Sub(last); quiet > 2*timeout {
+			problems = append(problems, fmt.Sprintf("collector for %s has received nothing for %s while connected", status.Host, quiet.Truncate(time.Second)))
+		}
+	}
+	if h.writer != nil {
+		stats := h.writer.Stats()
+		if age := now.Sub(stats.Heartbeat); age > h.config.stallTimeout() {
+			problems = append(problems, fmt.Sprintf("influxdb writer has not run for %s", age.Truncate(time.Second)))
+		}
+	}
+	return problems
+}
+
+// ready returns the reasons brul2influx is not doing its job: not being
+// the leader, hosts that are not connected or points that are not being
+// written.
+func (h *Health) ready() []string {
+	problems := h.live()
+	now := h.now()
+	if h.leading != nil && !h.leading() {
+		problems = append(problems, "not the leader, so not accepting packets")
+	}
+	for _, collector := range h.collectors() {
+		status := collector.Status()
+		if status.State != StateConnected && status.State != StateStopped {
+			problem := fmt.Sprintf("%s is %s since %s", status.Host, status.State, status.Since.Format(time.RFC3339))
+			if status.LastError != nil {
+				problem += ": " + status.LastError.Error()
+			}
+			problems = append(problems, problem)
+		}
+	}
+	if h.writer != nil {
+		stats := h.writer.Stats()
+		backlog := stats.QueueDepth + stats.Pending
+		if backlog > h.config.maxBacklog() {
+			problems = append(problems, fmt.Sprintf("%d points waiting to be written to influxdb", backlog))
+		}
+		age := now.Sub(stats.LastWrite)
+		if (backlog > 0 || stats.SpoolBytes > 0) && age > h.config.maxWriteAge() {
+			problems = append(problems, fmt.Sprintf("nothing written to influxdb for %s", age.Truncate(time.Second)))
+		}
+	}
+	return problems
+}
+
+func (h *Health) report(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+}
+
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.report(w, h.live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.report(w, h.ready())
+	})
+	return mux
+}
+
+// Serve runs an HTTP server for h until ctx is cancelled.
+func (h *Health) Serve(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              h.config.Address,
+		Handler:           h.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.WithFields(log.Fields{
+		"address": h.config.Address,
+	}).Info("serving health checks")
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
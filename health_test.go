@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/influxbg"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	writer, err := influxbg.NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		writer.Close(ctx)
+	}()
+
+	connected := NewCollector(&HostConfig{Address: "gem1:8000"}, writer)
+	connected.setState(StateConnected, nil)
+	reconnecting := NewCollector(&HostConfig{Address: "gem2:8000"}, writer)
+
+	leader := true
+	health := NewHealth(&HealthConfig{MaxBacklog: 5}, func() []*Collector {
+		return []*Collector{connected, reconnecting}
+	}, writer, func() bool { return leader })
+	handler := health.Handler()
+	check := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	if code, body := check("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d %q, want 200", code, body)
+	}
+	code, body := check("/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "gem2:8000 is connecting") {
+		t.Errorf("/readyz = %d %q, want gem2:8000 not ready", code, body)
+	}
+
+	reconnecting.setState(StateConnected, nil)
+	if code, body := check("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz = %d %q, want 200", code, body)
+	}
+
+	// a follower is live but not ready
+	leader = false
+	if code, body := check("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "not the leader") {
+		t.Errorf("/readyz = %d %q, want a follower not ready", code, body)
+	}
+	if code, body := check("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d %q, want a follower live", code, body)
+	}
+	leader = true
+
+	for i := 0; i < 10; i++ {
+		writer.Write("energy", nil, map[string]interface{}{"watts": float64(i)}, time.Unix(int64(i), 0))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for writer.Stats().QueueDepth+writer.Stats().Pending < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	health.now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	code, body = check("/readyz")
+	for _, want := range []string{"10 points waiting", "nothing written to influxdb for"} {
+		if code != http.StatusServiceUnavailable || !strings.Contains(body, want) {
+			t.Errorf("/readyz = %d %q, want %q", code, body, want)
+		}
+	}
+	if code, body := check("/healthz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "influxdb writer has not run") {
+		t.Errorf("/healthz = %d %q, want a stuck writer", code, body)
+	}
+
+	// a collector still connected well after it should have given up on
+	// a quiet device is wedged, whether or not it ever received a packet
+	health.now = time.Now
+	connected.received(time.Now())
+	if code, body := check("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d %q, want 200", code, body)
+	}
+	health.now = func() time.Time { return time.Now().Add(2*defaultInactivityTimeout + time.Second) }
+	code, body = check("/healthz")
+	for _, want := range []string{
+		"collector for gem1:8000 has received nothing for 1m",
+		"collector for gem2:8000 has received nothing for 1m",
+	} {
+		if code != http.StatusServiceUnavailable || !strings.Contains(body, want) {
+			t.Errorf("/healthz = %d %q, want %q", code, body, want)
+		}
+	}
+	connected.setState(StateBackoff, nil)
+	if code, body := check("/healthz"); strings.Contains(body, "gem1:8000") {
+		t.Errorf("/healthz = %d %q, want a reconnecting collector to be live", code, body)
+	}
+}
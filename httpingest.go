@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultMaxBodyBytes = 1 << 20
+
+// HTTPIngestConfig configures the HTTP server that accepts packets posted
+// by GEMs using their HTTP posting feature.
+type HTTPIngestConfig struct {
+	Address string `json:"address"`
+	// Path is the URL path packets are posted to, "/" by default.
+	Path         string `json:"path"`
+	MaxBodyBytes int64  `json:"max_body_bytes"`
+	// SecondsCounter writes each device's seconds counter; see
+	// HostConfig.SecondsCounter.
+	SecondsCounter bool `json:"seconds_counter"`
+	// Timestamps is "device" (the default) or "received"; see
+	// HostConfig.Timestamps.
+	Timestamps string `json:"timestamps"`
+}
+
+// HTTPIngest is an http.Handler that decodes posted GEM packets. The body
+// is either one or more ASCII packets separated by newlines or a single
+// form encoded packet.
+type HTTPIngest struct {
+	maxBodyBytes int64
+	handle       func(packet *gem.Packet, remote string)
+}
+
+func NewHTTPIngest(config *HTTPIngestConfig, handle func(packet *gem.Packet, remote string)) *HTTPIngest {
+	maxBodyBytes := config.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	return &HTTPIngest{
+		maxBodyBytes: maxBodyBytes,
+		handle:       handle,
+	}
+}
+
+func (h *HTTPIngest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+
+	var payloads [][]byte
+	var err error
+
+	mediaType := "text/plain"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid content type: %s", err), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		payloads, err = formPayloads(r)
+	case "text/plain", "application/octet-stream":
+		payloads, err = asciiPayloads(r.Body)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payloads) == 0 {
+		http.Error(w, "no packets in request body", http.StatusBadRequest)
+		return
+	}
+
+	source := sources.remoteSource(r.RemoteAddr)
+
+	// validate every packet before handling any so a request is all or nothing
+	packets := make([]*gem.Packet, 0, len(payloads))
+	for i, payload := range payloads {
+		packet, err := gem.ParseASCII(payload)
+		if err != nil {
+			source.parseError(err)
+			http.Error(w, fmt.Sprintf("packet %d: %s", i+1, err), http.StatusBadRequest)
+			return
+		}
+		if packet.Serial == "" {
+			http.Error(w, fmt.Sprintf("packet %d: missing serial number", i+1), http.StatusBadRequest)
+			return
+		}
+		packets = append(packets, packet)
+	}
+
+	for _, packet := range packets {
+		source.packet(time.Now())
+		h.handle(packet, r.RemoteAddr)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// asciiPayloads splits a body into one payload per non-empty line.
+func asciiPayloads(body io.Reader) ([][]byte, error) {
+	var payloads [][]byte
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		payloads = append(payloads, append([]byte{}, line...))
+	}
+	return payloads, scanner.Err()
+}
+
+// formPayloads turns a form encoded post back into the ASCII packet format
+// so that it is decoded by exactly the same code as every other source.
+func formPayloads(r *http.Request) ([][]byte, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Form) == 0 {
+		return nil, nil
+	}
+	return [][]byte{[]byte(encodeASCII(r.Form))}, nil
+}
+
+func encodeASCII(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range values[key] {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Serve runs an HTTP server for h until ctx is cancelled.
+func (h *HTTPIngest) Serve(ctx context.Context, config *HTTPIngestConfig) error {
+	path := config.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, h)
+
+	server := &http.Server{
+		Addr:              config.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.WithFields(log.Fields{
+		"address": config.Address,
+		"path":    path,
+	}).Info("accepting GEM HTTP posts")
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
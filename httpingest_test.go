@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+)
+
+func TestHTTPIngest(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		maxBody     int64
+		wantStatus  int
+		wantSerials []string
+	}{
+		{
+			name:        "ascii packet",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        "n=01000123&m=5&v=121.2&wh_1=10&p_1=300&a_1=2.5\r\n",
+			wantStatus:  http.StatusNoContent,
+			wantSerials: []string{"01000123"},
+		},
+		{
+			name:        "several ascii packets without content type",
+			method:      http.MethodPost,
+			body:        "n=1&v=120\n\nn=2&v=121\n",
+			wantStatus:  http.StatusNoContent,
+			wantSerials: []string{"1", "2"},
+		},
+		{
+			name:        "form encoded",
+			method:      http.MethodPost,
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        url.Values{"n": {"01000123"}, "v": {"119.9"}, "p_2": {"42"}}.Encode(),
+			wantStatus:  http.StatusNoContent,
+			wantSerials: []string{"01000123"},
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:        "unsupported content type",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"n":"1"}`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "empty body",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        "\r\n",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "bad field rejects the whole request",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        "n=1&v=120\nn=2&v=12x\n",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "missing serial",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        "v=120&p_1=3",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "body too large",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        "n=1&v=120&" + strings.Repeat("p_1=1&", 100),
+			maxBody:     64,
+			wantStatus:  http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu := sync.Mutex{}
+			var serials []string
+			ingest := NewHTTPIngest(&HTTPIngestConfig{MaxBodyBytes: tt.maxBody}, func(packet *gem.Packet, remote string) {
+				mu.Lock()
+				defer mu.Unlock()
+				serials = append(serials, packet.Serial)
+			})
+
+			server := httptest.NewServer(ingest)
+			defer server.Close()
+
+			req, err := http.NewRequest(tt.method, server.URL, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(serials, ",") != strings.Join(tt.wantSerials, ",") {
+				t.Errorf("handled serials %v, want %v", serials, tt.wantSerials)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package influxbg
+
+const (
+	defaultMaxBodyBytes = 1 << 20
+	// batchIncreaseSteps is how many successful writes it takes to grow
+	// from nothing back to the maximum batch size.
+	batchIncreaseSteps = 16
+	minBatchIncrease   = 1 << 10
+)
+
+// batchSize is an additive-increase/multiplicative-decrease controller for
+// the number of line protocol bytes sent in one request. It halves on a
+// request that was too large or too slow and creeps back up as requests
+// succeed, so a lowered limit on the server side is found quickly without
+// being stuck with small batches forever.
+type batchSize struct {
+	max     int
+	current int
+}
+
+func newBatchSize(max int) *batchSize {
+	if max <= 0 {
+		max = defaultMaxBodyBytes
+	}
+	return &batchSize{max: max, current: max}
+}
+
+func (b *batchSize) limit() int {
+	return b.current
+}
+
+// decrease halves the limit, or the size of the failed request if that
+// was already below it. There is no floor: a batch always holds at least
+// one point, so a tiny limit just means one point per request.
+func (b *batchSize) decrease(failed int) {
+	if failed < b.current {
+		b.current = failed
+	}
+	b.current /= 2
+}
+
+func (b *batchSize) increase() {
+	step := b.max / batchIncreaseSteps
+	if step < minBatchIncrease {
+		step = minBatchIncrease
+	}
+	b.current += step
+	if b.current > b.max {
+		b.current = b.max
+	}
+}
@@ -0,0 +1,30 @@
+package influxbg
+
+import "testing"
+
+func TestBatchSize(t *testing.T) {
+	b := newBatchSize(64 << 10)
+	if b.limit() != 64<<10 {
+		t.Fatalf("initial limit = %d", b.limit())
+	}
+
+	// a failed request smaller than the limit halves from its size
+	b.decrease(10 << 10)
+	if b.limit() != 5<<10 {
+		t.Errorf("limit after decrease = %d, want %d", b.limit(), 5<<10)
+	}
+
+	for i := 0; i < 100; i++ {
+		b.decrease(b.limit())
+	}
+	if b.limit() != 0 {
+		t.Errorf("limit = %d, want 0", b.limit())
+	}
+
+	for i := 0; i < batchIncreaseSteps; i++ {
+		b.increase()
+	}
+	if b.limit() != 64<<10 {
+		t.Errorf("limit after %d successes = %d, want %d", batchIncreaseSteps, b.limit(), 64<<10)
+	}
+}
@@ -0,0 +1,67 @@
+package influxbg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// deadLetterEntry is one line of the dead-letter file.
+type deadLetterEntry struct {
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error"`
+	Status int       `json:"status,omitempty"`
+	Point  string    `json:"point"`
+}
+
+// deadLetter appends points InfluxDB refused to accept to a file as JSON
+// lines, so they can be inspected and replayed by hand.
+type deadLetter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openDeadLetter(path string) (*deadLetter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetter{f: f}, nil
+}
+
+func (d *deadLetter) write(points []*client.Point, cause error) error {
+	entry := deadLetterEntry{
+		Time:  time.Now().UTC(),
+		Error: cause.Error(),
+	}
+	var writeErr *WriteError
+	if errors.As(cause, &writeErr) {
+		entry.Status = writeErr.StatusCode
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for _, point := range points {
+		entry.Point = point.String()
+		err := encoder.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.f.Write(buf.Bytes())
+	return err
+}
+
+func (d *deadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Close()
+}
@@ -0,0 +1,207 @@
+package influxbg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+const defaultWriteTimeout = 30 * time.Second
+
+// WriteError is returned when InfluxDB answers a write with anything other
+// than a 2xx status.
+type WriteError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *WriteError) Error() string {
+	body := strings.TrimSpace(e.Body)
+	if body == "" {
+		return fmt.Sprintf("influxdb returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("influxdb returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), body)
+}
+
+type writeOutcome int
+
+const (
+	writeOK writeOutcome = iota
+	// writeTransient failures are worth retrying unchanged later: server
+	// errors, timeouts and connection failures.
+	writeTransient
+	// writeTooLarge means the request has to be split to get through.
+	writeTooLarge
+	// writeBadPoints means some points in the request can never be
+	// written, such as a field type conflict. InfluxDB may still have
+	// written the others.
+	writeBadPoints
+	// writeBlocked means the server refuses every write until its
+	// configuration changes: bad credentials or a database that does not
+	// exist yet. The points are kept and retried like a transient failure.
+	writeBlocked
+	// writeRejected means the request as a whole was refused for a reason
+	// retrying will not fix.
+	writeRejected
+)
+
+func classify(err error) writeOutcome {
+	if err == nil {
+		return writeOK
+	}
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) {
+		return writeTransient
+	}
+	switch code := writeErr.StatusCode; {
+	case code == http.StatusRequestEntityTooLarge:
+		return writeTooLarge
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return writeTransient
+	case code == http.StatusBadRequest, code == http.StatusUnprocessableEntity:
+		// 2.x answers 422 for points it can parse but not store
+		return writeBadPoints
+	case code == http.StatusUnauthorized, code == http.StatusForbidden, code == http.StatusNotFound:
+		return writeBlocked
+	default:
+		return writeRejected
+	}
+}
+
+// isTimeout reports whether err means the write took too long, either on
+// our side or on the server's.
+func isTimeout(err error) bool {
+	var writeErr *WriteError
+	if errors.As(err, &writeErr) {
+		return writeErr.StatusCode == http.StatusRequestTimeout || writeErr.StatusCode == http.StatusGatewayTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// lineWriter posts line protocol to an InfluxDB write endpoint, either the
+// 1.x /write or the 2.x /api/v2/write, gzipping the body unless compression
+// is disabled.
+type lineWriter struct {
+	httpClient *http.Client
+	url        string
+	username   string
+	password   string
+	// token is sent as an "Authorization: Token" header for the 2.x API
+	token     string
+	userAgent string
+	compress  bool
+}
+
+func newLineWriter(conf client.HTTPConfig, endpoint string, params url.Values, compress bool) (*lineWriter, error) {
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported protocol scheme %q, address must start with http:// or https://", u.Scheme)
+	}
+	u.Path = path.Join(u.Path, endpoint)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+		},
+		Proxy:       conf.Proxy,
+		DialContext: conf.DialContext,
+	}
+	if conf.TLSConfig != nil {
+		tr.TLSClientConfig = conf.TLSConfig
+		tr.TLSClientConfig.InsecureSkipVerify = conf.InsecureSkipVerify
+	}
+
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+
+	userAgent := conf.UserAgent
+	if userAgent == "" {
+		userAgent = "brul2influx"
+	}
+
+	return &lineWriter{
+		httpClient: &http.Client{
+			Timeout:   timeout,
+			Transport: tr,
+		},
+		url:       u.String(),
+		username:  conf.Username,
+		password:  conf.Password,
+		userAgent: userAgent,
+		compress:  compress,
+	}, nil
+}
+
+func (lw *lineWriter) write(ctx context.Context, body []byte) error {
+	var reqBody io.Reader = bytes.NewReader(body)
+	if lw.compress {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		_, err := gz.Write(body)
+		if err != nil {
+			return err
+		}
+		err = gz.Close()
+		if err != nil {
+			return err
+		}
+		reqBody = buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lw.url, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", lw.userAgent)
+	if lw.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if lw.username != "" {
+		req.SetBasicAuth(lw.username, lw.password)
+	}
+	if lw.token != "" {
+		req.Header.Set("Authorization", "Token "+lw.token)
+	}
+
+	resp, err := lw.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return &WriteError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return nil
+}
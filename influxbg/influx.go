@@ -0,0 +1,792 @@
+package influxbg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lib/ticker"
+)
+
+const (
+	defaultReplayBatch = 5000
+	flushRetryInterval = time.Second
+	maxRetryInterval   = time.Minute
+	defaultPrecision   = "ms"
+)
+
+// precisions maps the supported timestamp precisions to the names the 1.x
+// write endpoint and the line protocol encoder use; the 2.x endpoint takes
+// them as they are.
+var precisions = map[string]string{
+	"s":  "s",
+	"ms": "ms",
+	"us": "u",
+	"ns": "n",
+}
+
+// ErrClosed is returned by Write, Flush and Close once the writer has been
+// closed.
+var ErrClosed = errors.New("influxbg: writer closed")
+
+// FlushError is returned by Flush and Close when not every pending point
+// could be written before the context expired. Points left over by Flush
+// stay queued; points left over by Close are dropped.
+type FlushError struct {
+	Points int
+	Err    error
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("%d points not written: %s", e.Points, e.Err)
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+type flushRequest struct {
+	ctx    context.Context
+	close  bool
+	result chan error
+}
+
+// Stats counts what happened to the points handed to the writer.
+type Stats struct {
+	// Written is the number of points InfluxDB accepted.
+	Written uint64
+	// Dropped is the number of points given up on without InfluxDB
+	// having refused them, such as when shutting down.
+	Dropped uint64
+	// Rejected is the number of points InfluxDB will never accept; they
+	// are written to the dead-letter file if one is configured.
+	Rejected uint64
+	// Retries is the number of requests resent in smaller pieces after
+	// InfluxDB rejected them.
+	Retries uint64
+	// BatchBytes is the current limit on line protocol bytes per request.
+	BatchBytes int
+
+	// QueueDepth is the number of points waiting to be picked up by the
+	// writer, and Pending the number it holds in memory because they
+	// could not be written yet.
+	QueueDepth int
+	Pending    int
+	// SpoolBytes is the size of the on-disk spool.
+	SpoolBytes int64
+	// LastBatchPoints and LastBatchBytes describe the last batch that was
+	// written successfully.
+	LastBatchPoints int
+	LastBatchBytes  int
+	// Requests counts write requests and WriteTime the total time spent
+	// on them.
+	Requests  uint64
+	WriteTime time.Duration
+	// TooLarge and ServerErrors count 413 and 5xx responses.
+	TooLarge     uint64
+	ServerErrors uint64
+	// LastWrite is when a write request last succeeded, or when the
+	// writer was created if none has.
+	LastWrite time.Time
+	// Heartbeat is when the writer's loop last ran. It runs at least once
+	// a minute unless a write request is stuck.
+	Heartbeat time.Time
+}
+
+type InfluxBGWriter struct {
+	pointChannel chan *client.Point
+	lineWriter   *lineWriter
+	precision    string
+	// MaxPoints, when positive, caps the number of points per request in
+	// addition to the byte size limit.
+	MaxPoints  int
+	spool      *Spool
+	deadLetter *deadLetter
+	batch      *batchSize
+
+	written    atomic.Uint64
+	dropped    atomic.Uint64
+	rejected   atomic.Uint64
+	retries    atomic.Uint64
+	batchBytes atomic.Int64
+
+	pending         atomic.Int64
+	lastBatchPoints atomic.Int64
+	lastBatchBytes  atomic.Int64
+	requests        atomic.Uint64
+	writeTime       atomic.Int64
+	tooLarge        atomic.Uint64
+	serverErrors    atomic.Uint64
+	lastWrite       atomic.Int64
+	heartbeat       atomic.Int64
+
+	flushRequests chan flushRequest
+	closing       chan struct{}
+	closeOnce     sync.Once
+	done          chan struct{}
+
+	// closeMu is held for reading while Write enqueues a point and for
+	// writing while Close marks the writer closed, so that no point is
+	// enqueued after the writer drains the queue for the last time.
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// Options holds optional settings for NewInfluxBGWriterWithOptions.
+type Options struct {
+	// Spool, when set, stores points that can not be written on disk
+	// instead of in memory and replays them once writes succeed again.
+	Spool *SpoolConfig
+	// MaxBodyBytes caps the uncompressed size of a single write request;
+	// it defaults to 1MiB.
+	MaxBodyBytes int
+	// DisableCompression sends request bodies without gzip.
+	DisableCompression bool
+	// Precision is the timestamp precision points are written with, one
+	// of "s", "ms" (the default), "us" or "ns". Points with the same tags
+	// and a timestamp that is equal at this precision overwrite each
+	// other.
+	Precision string
+	// DeadLetter is the path of a file that points InfluxDB refuses to
+	// accept are appended to, with the error, as JSON lines. Without it
+	// they are only logged.
+	DeadLetter string
+}
+
+func (w *InfluxBGWriter) writer() {
+	dynamicTicker := ticker.NewDynamicTicker(time.Second)
+	defer dynamicTicker.Stop()
+	var pending []*client.Point
+	// failures counts consecutive transient failures to back off retries
+	failures := 0
+
+	for {
+		w.pending.Store(int64(len(pending)))
+		w.heartbeat.Store(time.Now().UnixNano())
+
+		select {
+		case v := <-w.pointChannel:
+			pending = append(pending, v)
+		case req := <-w.flushRequests:
+			pending = append(pending, w.drain()...)
+			w.pending.Store(int64(len(pending)))
+
+			remaining, err := w.flush(req.ctx, pending)
+			if req.close {
+				w.dropped.Add(uint64(len(remaining)))
+				if w.spool != nil {
+					w.spool.Close()
+				}
+				if w.deadLetter != nil {
+					w.deadLetter.Close()
+				}
+				close(w.done)
+				req.result <- err
+				return
+			}
+			pending = remaining
+			req.result <- err
+		case <-dynamicTicker.C:
+			if w.spool != nil && !w.spool.Empty() {
+				// new points queue up behind the spooled ones so that
+				// everything is written back in order
+				w.spoolPoints(pending)
+				pending = nil
+				more, err := w.replaySpool()
+				switch {
+				case err != nil:
+					failures++
+					dynamicTicker.SetInterval(retryInterval(failures))
+				case more:
+					failures = 0
+					dynamicTicker.SetInterval(100 * time.Millisecond)
+				default:
+					failures = 0
+					dynamicTicker.SetInterval(time.Second)
+				}
+				continue
+			}
+
+			if len(pending) == 0 {
+				continue
+			}
+
+			n, err := w.writeBatch(context.Background(), pending)
+			pending = pending[n:]
+			if err != nil {
+				failures++
+				log.WithFields(log.Fields{
+					"error":          err,
+					"points-pending": len(pending),
+					"retry-in":       retryInterval(failures),
+				}).Error("writing to influxdb failed")
+				if w.spool != nil {
+					w.spoolPoints(pending)
+					pending = nil
+				}
+				dynamicTicker.SetInterval(retryInterval(failures))
+				continue
+			}
+			failures = 0
+
+			// keep writing quickly while there is a backlog
+			if len(pending) > 0 {
+				dynamicTicker.SetInterval(100 * time.Millisecond)
+			} else {
+				dynamicTicker.SetInterval(time.Second)
+			}
+		}
+	}
+}
+
+// retryInterval backs off exponentially from a second to a minute over
+// consecutive transient failures.
+func retryInterval(failures int) time.Duration {
+	interval := time.Second
+	for i := 1; i < failures && interval < maxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxRetryInterval {
+		interval = maxRetryInterval
+	}
+	return interval
+}
+
+func (w *InfluxBGWriter) encodePoints(points []*client.Point) []byte {
+	buf := &bytes.Buffer{}
+	for _, point := range points {
+		buf.WriteString(point.PrecisionString(w.precision))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// encodeBatch encodes the longest prefix of points that fits within the
+// current batch size, always including at least one point. It returns the
+// number of points encoded.
+func (w *InfluxBGWriter) encodeBatch(points []*client.Point) (int, []byte) {
+	limit := w.batch.limit()
+	buf := &bytes.Buffer{}
+	n := 0
+	for _, point := range points {
+		if w.MaxPoints > 0 && n >= w.MaxPoints {
+			break
+		}
+		line := point.PrecisionString(w.precision)
+		if n > 0 && buf.Len()+len(line)+1 > limit {
+			break
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		n++
+	}
+	return n, buf.Bytes()
+}
+
+// writeBatch writes one request's worth of points from the front of
+// points and returns how many were consumed, either written or rejected.
+// Requests refused as too large or for containing bad points are split
+// until every point has either been written or rejected on its own; only
+// transient errors are returned, for the caller to retry.
+func (w *InfluxBGWriter) writeBatch(ctx context.Context, points []*client.Point) (int, error) {
+	for {
+		n, body := w.encodeBatch(points)
+		if n == 0 {
+			return 0, nil
+		}
+
+		err := w.send(ctx, body)
+		switch classify(err) {
+		case writeOK:
+			w.batch.increase()
+			w.batchBytes.Store(int64(w.batch.limit()))
+			w.written.Add(uint64(n))
+			w.lastBatchPoints.Store(int64(n))
+			w.lastBatchBytes.Store(int64(len(body)))
+			log.WithFields(log.Fields{
+				"points": n,
+				"bytes":  len(body),
+			}).Debug("wrote to influxdb")
+			return n, nil
+
+		case writeTooLarge:
+			if n == 1 {
+				w.reject(points[:1], err)
+				return 1, nil
+			}
+			w.batch.decrease(len(body))
+			w.batchBytes.Store(int64(w.batch.limit()))
+			w.retries.Add(1)
+			log.WithFields(log.Fields{
+				"error":       err,
+				"points":      n,
+				"bytes":       len(body),
+				"batch-bytes": w.batch.limit(),
+			}).Info("content too large, retrying with a smaller batch")
+
+		case writeBadPoints:
+			log.WithFields(log.Fields{
+				"error":  err,
+				"points": n,
+			}).Warn("influxdb refused points, splitting the batch to isolate them")
+			return w.isolate(ctx, points[:n], err)
+
+		case writeRejected:
+			w.reject(points[:n], err)
+			return n, nil
+
+		case writeBlocked:
+			return 0, err
+
+		default:
+			if isTimeout(err) {
+				w.batch.decrease(len(body))
+				w.batchBytes.Store(int64(w.batch.limit()))
+			}
+			return 0, err
+		}
+	}
+}
+
+// send makes one write request, recording how long it took and how it
+// failed.
+func (w *InfluxBGWriter) send(ctx context.Context, body []byte) error {
+	started := time.Now()
+	err := w.lineWriter.write(ctx, body)
+	w.requests.Add(1)
+	w.writeTime.Add(int64(time.Since(started)))
+	if err == nil {
+		w.lastWrite.Store(time.Now().UnixNano())
+	}
+
+	var writeErr *WriteError
+	if errors.As(err, &writeErr) {
+		switch {
+		case writeErr.StatusCode == http.StatusRequestEntityTooLarge:
+			w.tooLarge.Add(1)
+		case writeErr.StatusCode >= 500:
+			w.serverErrors.Add(1)
+		}
+	}
+	return err
+}
+
+// isolate writes points that InfluxDB refused as a batch in halves,
+// recursing into the halves that are refused again, until each bad point
+// is rejected on its own. Rewriting points that a partial write already
+// stored is harmless as they overwrite themselves. It returns how many
+// points were consumed before a transient error, if any.
+func (w *InfluxBGWriter) isolate(ctx context.Context, points []*client.Point, cause error) (int, error) {
+	if len(points) == 1 {
+		w.reject(points, cause)
+		return 1, nil
+	}
+
+	w.retries.Add(1)
+	mid := len(points) / 2
+	consumed := 0
+	for _, half := range [][]*client.Point{points[:mid], points[mid:]} {
+		err := w.send(ctx, w.encodePoints(half))
+		switch classify(err) {
+		case writeOK:
+			w.written.Add(uint64(len(half)))
+		case writeBadPoints, writeTooLarge:
+			n, err := w.isolate(ctx, half, err)
+			if err != nil {
+				return consumed + n, err
+			}
+		case writeRejected:
+			w.reject(half, err)
+		default:
+			return consumed, err
+		}
+		consumed += len(half)
+	}
+	return consumed, nil
+}
+
+// reject gives up on points InfluxDB will never accept, saving them to the
+// dead-letter file if there is one.
+func (w *InfluxBGWriter) reject(points []*client.Point, cause error) {
+	w.rejected.Add(uint64(len(points)))
+
+	fields := log.Fields{
+		"error":  cause,
+		"points": len(points),
+	}
+	if len(points) == 1 {
+		fields["point"] = points[0].String()
+	}
+
+	if w.deadLetter == nil {
+		log.WithFields(fields).Error("dropping points influxdb refused")
+		return
+	}
+	err := w.deadLetter.write(points, cause)
+	if err != nil {
+		fields["dead-letter-error"] = err
+		log.WithFields(fields).Error("unable to write refused points to dead-letter file, dropping them")
+		return
+	}
+	log.WithFields(fields).Error("moved points influxdb refused to dead-letter file")
+}
+
+// drain returns every point waiting in pointChannel without blocking.
+func (w *InfluxBGWriter) drain() []*client.Point {
+	var points []*client.Point
+	for {
+		select {
+		case v := <-w.pointChannel:
+			points = append(points, v)
+		default:
+			return points
+		}
+	}
+}
+
+// flush writes points, and anything spooled ahead of them, until they are
+// all written or ctx expires. It returns the points that were neither
+// written nor spooled.
+func (w *InfluxBGWriter) flush(ctx context.Context, points []*client.Point) ([]*client.Point, error) {
+	if w.spool != nil && !w.spool.Empty() {
+		w.spoolPoints(points)
+		for !w.spool.Empty() {
+			if ctx.Err() != nil {
+				// still on disk, so nothing is lost
+				log.WithFields(log.Fields{
+					"spooled-size": w.spool.Size(),
+				}).Warn("leaving points in spool")
+				return nil, nil
+			}
+			more, err := w.replaySpool()
+			if err != nil || !more {
+				select {
+				case <-ctx.Done():
+				case <-time.After(flushRetryInterval):
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	for len(points) > 0 {
+		if ctx.Err() != nil {
+			return points, &FlushError{Points: len(points), Err: ctx.Err()}
+		}
+
+		n, err := w.writeBatch(ctx, points)
+		points = points[n:]
+		w.pending.Store(int64(len(points)))
+		if err == nil {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"error":            err,
+			"points-remaining": len(points),
+		}).Error("flushing to influxdb failed")
+
+		if w.spool != nil {
+			w.spoolPoints(points)
+			return nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(flushRetryInterval):
+		}
+	}
+	return nil, nil
+}
+
+// Flush writes every point queued so far, retrying until ctx expires.
+// Points that could not be written are kept for the next attempt and
+// reported in a *FlushError.
+func (w *InfluxBGWriter) Flush(ctx context.Context) error {
+	return w.request(ctx, false)
+}
+
+// Close stops accepting points and writes everything still queued, or
+// spools it if a spool is configured, until ctx expires. Points that could
+// not be written are dropped and reported in a *FlushError.
+func (w *InfluxBGWriter) Close(ctx context.Context) error {
+	closed := false
+	w.closeOnce.Do(func() {
+		// closing first unblocks any Write waiting on a full queue, so
+		// that taking closeMu does not wait for it
+		close(w.closing)
+		w.closeMu.Lock()
+		w.closed = true
+		w.closeMu.Unlock()
+		closed = true
+	})
+	if !closed {
+		return ErrClosed
+	}
+
+	err := w.request(ctx, true)
+
+	var flushErr *FlushError
+	if errors.As(err, &flushErr) {
+		log.WithFields(log.Fields{
+			"error":   flushErr.Err,
+			"dropped": flushErr.Points,
+		}).Error("dropping points that could not be written before shutdown")
+	}
+	return err
+}
+
+func (w *InfluxBGWriter) request(ctx context.Context, final bool) error {
+	req := flushRequest{
+		ctx:    ctx,
+		close:  final,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case w.flushRequests <- req:
+	case <-w.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return &FlushError{Points: w.unwritten(), Err: ctx.Err()}
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+	}
+
+	// the writer notices ctx expiring between writes, but may be stuck in
+	// a write that does not honour it
+	select {
+	case err := <-req.result:
+		return err
+	case <-time.After(flushRetryInterval):
+		return &FlushError{Points: w.unwritten(), Err: ctx.Err()}
+	}
+}
+
+// unwritten returns the number of points the writer holds, both those in
+// the batch it is writing and those still queued behind it.
+func (w *InfluxBGWriter) unwritten() int {
+	return int(w.pending.Load()) + len(w.pointChannel)
+}
+
+// Stats returns the writer's counters.
+func (w *InfluxBGWriter) Stats() Stats {
+	stats := Stats{
+		Written:         w.written.Load(),
+		Dropped:         w.dropped.Load(),
+		Rejected:        w.rejected.Load(),
+		Retries:         w.retries.Load(),
+		BatchBytes:      int(w.batchBytes.Load()),
+		QueueDepth:      len(w.pointChannel),
+		Pending:         int(w.pending.Load()),
+		LastBatchPoints: int(w.lastBatchPoints.Load()),
+		LastBatchBytes:  int(w.lastBatchBytes.Load()),
+		Requests:        w.requests.Load(),
+		WriteTime:       time.Duration(w.writeTime.Load()),
+		TooLarge:        w.tooLarge.Load(),
+		ServerErrors:    w.serverErrors.Load(),
+		LastWrite:       time.Unix(0, w.lastWrite.Load()),
+		Heartbeat:       time.Unix(0, w.heartbeat.Load()),
+	}
+	if w.spool != nil {
+		stats.SpoolBytes = w.spool.Size()
+	}
+	return stats
+}
+
+// spoolPoints appends points to the spool, falling back to dropping them
+// with an error if the spool can not be written.
+func (w *InfluxBGWriter) spoolPoints(points []*client.Point) {
+	if len(points) == 0 {
+		return
+	}
+	err := w.spool.Append(points)
+	if err != nil {
+		w.dropped.Add(uint64(len(points)))
+		log.WithFields(log.Fields{
+			"error":  err,
+			"points": len(points),
+		}).Error("unable to spool points, dropping them")
+	}
+}
+
+// replaySpool writes one batch of spooled points back to influxdb. It
+// returns true if the batch was written and more may be waiting.
+func (w *InfluxBGWriter) replaySpool() (bool, error) {
+	points, err := w.spool.Next(defaultReplayBatch)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("unable to read spooled points")
+		return false, err
+	}
+	if len(points) == 0 {
+		return false, nil
+	}
+
+	n, err := w.writeBatch(context.Background(), points)
+	w.spool.Commit(n)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"points":       len(points),
+			"spooled-size": w.spool.Size(),
+		}).Error("replaying spooled points failed")
+		return false, err
+	}
+
+	log.WithFields(log.Fields{
+		"points":       n,
+		"spooled-size": w.spool.Size(),
+	}).Info("replayed spooled points")
+
+	return true, nil
+}
+
+func (w *InfluxBGWriter) Write(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) error {
+	point, err := client.NewPoint(measurement, tags, fields, ts)
+	if err != nil {
+		return err
+	}
+
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	select {
+	case w.pointChannel <- point:
+	case <-w.closing:
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func NewInfluxBGWriter(httpConfig client.HTTPConfig, database string) (*InfluxBGWriter, error) {
+	return NewInfluxBGWriterWithOptions(httpConfig, database, Options{})
+}
+
+// V2Target selects where the InfluxDB 2.x write API stores points. InfluxDB
+// 3.x accepts the same API, with the database as the bucket and no org.
+type V2Target struct {
+	Org    string
+	Bucket string
+	Token  string
+}
+
+// NewInfluxBGWriterWithOptions returns a writer for the InfluxDB 1.x write
+// API.
+func NewInfluxBGWriterWithOptions(httpConfig client.HTTPConfig, database string, options Options) (*InfluxBGWriter, error) {
+	if options.Precision == "" {
+		options.Precision = defaultPrecision
+	}
+	precision, ok := precisions[options.Precision]
+	if !ok {
+		return nil, fmt.Errorf("unknown precision %q", options.Precision)
+	}
+
+	lineWriter, err := newLineWriter(httpConfig, "write", url.Values{
+		"db":        {database},
+		"precision": {precision},
+	}, !options.DisableCompression)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"address": httpConfig.Addr,
+		}).Error("unable to create new influx HTTP client")
+		return nil, err
+	}
+
+	return newInfluxBGWriter(lineWriter, precision, options)
+}
+
+// NewInfluxV2BGWriter returns a writer for the InfluxDB 2.x write API, which
+// InfluxDB 3.x also serves.
+func NewInfluxV2BGWriter(httpConfig client.HTTPConfig, target V2Target, options Options) (*InfluxBGWriter, error) {
+	if options.Precision == "" {
+		options.Precision = defaultPrecision
+	}
+	precision, ok := precisions[options.Precision]
+	if !ok {
+		return nil, fmt.Errorf("unknown precision %q", options.Precision)
+	}
+	if target.Bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+
+	params := url.Values{
+		"bucket":    {target.Bucket},
+		"precision": {options.Precision},
+	}
+	if target.Org != "" {
+		params.Set("org", target.Org)
+	}
+	lineWriter, err := newLineWriter(httpConfig, "api/v2/write", params, !options.DisableCompression)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"address": httpConfig.Addr,
+		}).Error("unable to create new influx HTTP client")
+		return nil, err
+	}
+	lineWriter.token = target.Token
+
+	return newInfluxBGWriter(lineWriter, precision, options)
+}
+
+func newInfluxBGWriter(lineWriter *lineWriter, precision string, options Options) (*InfluxBGWriter, error) {
+	var err error
+	ibw := &InfluxBGWriter{
+		pointChannel: make(chan *client.Point, 100000),
+		lineWriter:   lineWriter,
+		precision:    precision,
+		batch:        newBatchSize(options.MaxBodyBytes),
+
+		flushRequests: make(chan flushRequest),
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	ibw.batchBytes.Store(int64(ibw.batch.limit()))
+	ibw.lastWrite.Store(time.Now().UnixNano())
+	ibw.heartbeat.Store(time.Now().UnixNano())
+
+	if options.DeadLetter != "" {
+		ibw.deadLetter, err = openDeadLetter(options.DeadLetter)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"path":  options.DeadLetter,
+			}).Error("unable to open dead-letter file")
+			return nil, err
+		}
+	}
+
+	if options.Spool != nil {
+		ibw.spool, err = OpenSpool(*options.Spool)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"dir":   options.Spool.Dir,
+			}).Error("unable to open spool")
+			return nil, err
+		}
+	}
+
+	go ibw.writer()
+
+	return ibw, nil
+}
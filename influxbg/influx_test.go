@@ -0,0 +1,520 @@
+package influxbg
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// influxServer is a fake InfluxDB that records the lines written to it.
+type influxServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	// maxBody rejects larger uncompressed bodies with a 413 when set
+	maxBody int
+	// reject answers a 400 partial write, after storing the other lines,
+	// when a line contains it
+	reject string
+	bodies []int
+	lines  []string
+	// requests records the URL and headers of each request
+	requests []*http.Request
+}
+
+func newInfluxServer(t *testing.T) *influxServer {
+	s := &influxServer{status: http.StatusNoContent}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("request body is not gzipped: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reader = gz
+		}
+		body, _ := io.ReadAll(reader)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		if s.maxBody > 0 && len(body) > s.maxBody {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.bodies = append(s.bodies, len(body))
+		if s.status != http.StatusNoContent {
+			w.WriteHeader(s.status)
+			return
+		}
+		dropped := 0
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if s.reject != "" && strings.Contains(line, s.reject) {
+				dropped++
+				continue
+			}
+			s.lines = append(s.lines, line)
+		}
+		if dropped > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":"partial write: field type conflict dropped=%d"}`, dropped)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *influxServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *influxServer) written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lines)
+}
+
+func TestCloseWritesPendingPoints(t *testing.T) {
+	server := newInfluxServer(t)
+	w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := w.Write("energy", nil, map[string]interface{}{"watts": i}, time.Unix(int64(i), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := server.written(); got != 100 {
+		t.Errorf("wrote %d points, want 100", got)
+	}
+
+	if err := w.Write("energy", nil, map[string]interface{}{"watts": 1}, time.Now()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write() after Close error = %v, want ErrClosed", err)
+	}
+	if err := w.Close(ctx); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close() error = %v, want ErrClosed", err)
+	}
+}
+
+func TestFlushKeepsPointsThatCouldNotBeWritten(t *testing.T) {
+	server := newInfluxServer(t)
+	server.setStatus(http.StatusServiceUnavailable)
+	w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		w.Write("energy", nil, map[string]interface{}{"watts": i}, time.Unix(int64(i), 0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = w.Flush(ctx)
+	var flushErr *FlushError
+	if !errors.As(err, &flushErr) || flushErr.Points != 10 {
+		t.Fatalf("Flush() error = %v, want 10 points not written", err)
+	}
+
+	server.setStatus(http.StatusNoContent)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := server.written(); got != 10 {
+		t.Errorf("wrote %d points, want 10", got)
+	}
+}
+
+func TestCloseReportsDroppedPoints(t *testing.T) {
+	server := newInfluxServer(t)
+	server.setStatus(http.StatusServiceUnavailable)
+	w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		w.Write("energy", nil, map[string]interface{}{"watts": i}, time.Unix(int64(i), 0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = w.Close(ctx)
+	var flushErr *FlushError
+	if !errors.As(err, &flushErr) || flushErr.Points != 3 {
+		t.Fatalf("Close() error = %v, want 3 points dropped", err)
+	}
+}
+
+func TestCloseCountsPointsInAStuckWrite(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	defer close(release)
+	w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		w.Write("energy", nil, map[string]interface{}{"watts": i}, time.Unix(int64(i), 0))
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no write request")
+	}
+	// queued behind the batch being written
+	for i := 3; i < 5; i++ {
+		w.Write("energy", nil, map[string]interface{}{"watts": i}, time.Unix(int64(i), 0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = w.Close(ctx)
+	var flushErr *FlushError
+	if !errors.As(err, &flushErr) || flushErr.Points != 5 {
+		t.Fatalf("Close() error = %v, want 5 points dropped", err)
+	}
+	if err := w.Write("energy", nil, map[string]interface{}{"watts": 5}, time.Now()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write() after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestWriterSplitsBatchesRejectedAsTooLarge(t *testing.T) {
+	server := newInfluxServer(t)
+	server.maxBody = 2000
+	w, err := NewInfluxBGWriterWithOptions(client.HTTPConfig{Addr: server.URL}, "gem", Options{MaxBodyBytes: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		w.Write("energy", map[string]string{"serial": "01000123", "channel": "1"}, map[string]interface{}{"watts": float64(i)}, time.Unix(int64(i), 0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Flush(ctx); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if got := server.written(); got != 500 {
+		t.Errorf("wrote %d points, want 500", got)
+	}
+
+	stats := w.Stats()
+	if stats.Written != 500 || stats.Dropped != 0 {
+		t.Errorf("stats = %+v, want 500 written and none dropped", stats)
+	}
+	if stats.Retries == 0 || stats.TooLarge == 0 {
+		t.Errorf("stats = %+v, want retries and 413s counted", stats)
+	}
+	if stats.Requests <= stats.TooLarge || stats.WriteTime <= 0 {
+		t.Errorf("stats = %+v, want requests and write time recorded", stats)
+	}
+	if stats.LastBatchPoints == 0 || stats.LastBatchBytes > 2000 {
+		t.Errorf("stats = %+v, want the last batch to fit within 2000 bytes", stats)
+	}
+	if stats.BatchBytes >= 64<<10 {
+		t.Errorf("batch size %d did not shrink", stats.BatchBytes)
+	}
+	for _, size := range server.bodies {
+		if size > 2000 {
+			t.Errorf("accepted body of %d bytes", size)
+		}
+	}
+	w.Close(ctx)
+}
+
+func TestWriterDropsPointTooLargeToWrite(t *testing.T) {
+	server := newInfluxServer(t)
+	server.maxBody = 100
+	w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write("energy", nil, map[string]interface{}{"note": strings.Repeat("x", 200)}, time.Unix(1, 0))
+	w.Write("energy", nil, map[string]interface{}{"watts": 1.0}, time.Unix(2, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := server.written(); got != 1 {
+		t.Errorf("wrote %d points, want 1", got)
+	}
+	if stats := w.Stats(); stats.Written != 1 || stats.Rejected != 1 {
+		t.Errorf("stats = %+v, want 1 written and 1 rejected", stats)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		want writeOutcome
+	}{
+		{nil, writeOK},
+		{errors.New("dial tcp: connection refused"), writeTransient},
+		{context.DeadlineExceeded, writeTransient},
+		{&WriteError{StatusCode: http.StatusServiceUnavailable}, writeTransient},
+		{&WriteError{StatusCode: http.StatusTooManyRequests}, writeTransient},
+		{&WriteError{StatusCode: http.StatusRequestEntityTooLarge}, writeTooLarge},
+		{&WriteError{StatusCode: http.StatusBadRequest, Body: "partial write: field type conflict"}, writeBadPoints},
+		{&WriteError{StatusCode: http.StatusUnauthorized}, writeBlocked},
+		{&WriteError{StatusCode: http.StatusForbidden}, writeBlocked},
+		{&WriteError{StatusCode: http.StatusNotFound, Body: "database not found"}, writeBlocked},
+		{&WriteError{StatusCode: http.StatusMethodNotAllowed}, writeRejected},
+	}
+	for _, tt := range tests {
+		if got := classify(tt.err); got != tt.want {
+			t.Errorf("classify(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriterIsolatesPoisonPoints(t *testing.T) {
+	server := newInfluxServer(t)
+	server.reject = "poison"
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	w, err := NewInfluxBGWriterWithOptions(client.HTTPConfig{Addr: server.URL}, "gem", Options{DeadLetter: deadLetterPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		tags := map[string]string{"channel": "1"}
+		if i == 17 || i == 80 {
+			tags["channel"] = "poison"
+		}
+		w.Write("energy", tags, map[string]interface{}{"watts": float64(i)}, time.Unix(int64(i), 0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if stats := w.Stats(); stats.Written != 98 || stats.Rejected != 2 {
+		t.Errorf("stats = %+v, want 98 written and 2 rejected", stats)
+	}
+
+	data, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("dead-letter file has %d lines, want 2:\n%s", len(lines), data)
+	}
+	for _, line := range lines {
+		var entry deadLetterEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(entry.Point, "poison") || entry.Status != http.StatusBadRequest || !strings.Contains(entry.Error, "field type conflict") {
+			t.Errorf("dead-letter entry = %+v", entry)
+		}
+	}
+}
+
+func TestWriterRetriesTransientErrors(t *testing.T) {
+	server := newInfluxServer(t)
+	server.setStatus(http.StatusBadGateway)
+	w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		w.Write("energy", nil, map[string]interface{}{"watts": float64(i)}, time.Unix(int64(i), 0))
+	}
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server.setStatus(http.StatusNoContent)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if stats := w.Stats(); stats.Written != 10 || stats.Rejected != 0 || stats.Dropped != 0 || stats.ServerErrors == 0 {
+		t.Errorf("stats = %+v, want all 10 written after 5xx responses", stats)
+	}
+}
+
+func TestWriterKeepsPointsWhileBlocked(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server := newInfluxServer(t)
+			server.setStatus(status)
+			w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 10; i++ {
+				w.Write("energy", nil, map[string]interface{}{"watts": float64(i)}, time.Unix(int64(i), 0))
+			}
+
+			// the credentials are fixed while the writer backs off
+			go func() {
+				time.Sleep(300 * time.Millisecond)
+				server.setStatus(http.StatusNoContent)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := w.Close(ctx); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if stats := w.Stats(); stats.Written != 10 || stats.Rejected != 0 || stats.Dropped != 0 {
+				t.Errorf("stats = %+v, want all 10 written once allowed", stats)
+			}
+		})
+	}
+}
+
+func TestWriterRejectsRefusedRequests(t *testing.T) {
+	server := newInfluxServer(t)
+	server.setStatus(http.StatusMethodNotAllowed)
+	w, err := NewInfluxBGWriter(client.HTTPConfig{Addr: server.URL}, "gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		w.Write("energy", nil, map[string]interface{}{"watts": float64(i)}, time.Unix(int64(i), 0))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if stats := w.Stats(); stats.Rejected != 10 {
+		t.Errorf("stats = %+v, want 10 rejected", stats)
+	}
+}
+
+func TestWriterPrecision(t *testing.T) {
+	ts := time.Unix(1700000000, 123456789)
+	tests := []struct {
+		precision string
+		want      string
+	}{
+		{"", "1700000000123"},
+		{"s", "1700000000"},
+		{"ms", "1700000000123"},
+		{"us", "1700000000123456"},
+		{"ns", "1700000000123456789"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.precision, func(t *testing.T) {
+			server := newInfluxServer(t)
+			w, err := NewInfluxBGWriterWithOptions(client.HTTPConfig{Addr: server.URL}, "gem", Options{Precision: tt.precision})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write("voltage", nil, map[string]interface{}{"volts": 120.0}, ts)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := w.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if len(server.lines) != 1 || !strings.HasSuffix(server.lines[0], " "+tt.want) {
+				t.Errorf("lines = %q, want timestamp %s", server.lines, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewInfluxBGWriterWithOptions(client.HTTPConfig{Addr: "http://localhost"}, "gem", Options{Precision: "h"}); err == nil {
+		t.Error("unsupported precision accepted")
+	}
+}
+
+func TestV2Writer(t *testing.T) {
+	server := newInfluxServer(t)
+	w, err := NewInfluxV2BGWriter(client.HTTPConfig{Addr: server.URL}, V2Target{Org: "home", Bucket: "gem", Token: "secret"}, Options{Precision: "us"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write("voltage", map[string]string{"serial": "01000123"}, map[string]interface{}{"volts": 120.5}, time.Unix(1700000000, 123456789))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(server.requests))
+	}
+	req := server.requests[0]
+	if req.URL.Path != "/api/v2/write" {
+		t.Errorf("path = %q, want /api/v2/write", req.URL.Path)
+	}
+	query := req.URL.Query()
+	if query.Get("org") != "home" || query.Get("bucket") != "gem" || query.Get("precision") != "us" {
+		t.Errorf("query = %v", query)
+	}
+	if got := req.Header.Get("Authorization"); got != "Token secret" {
+		t.Errorf("Authorization = %q, want %q", got, "Token secret")
+	}
+	want := "voltage,serial=01000123 volts=120.5 1700000000123456"
+	if len(server.lines) != 1 || server.lines[0] != want {
+		t.Errorf("lines = %q, want %q", server.lines, want)
+	}
+
+	if _, err := NewInfluxV2BGWriter(client.HTTPConfig{Addr: server.URL}, V2Target{Org: "home"}, Options{}); err == nil {
+		t.Error("writer without a bucket accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package influxbg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy describes an InfluxDB 1.x retention policy. Durations are
+// InfluxQL duration literals such as "30d" or "INF".
+type RetentionPolicy struct {
+	Name          string
+	Duration      string
+	Replication   int
+	ShardDuration string
+	Default       bool
+}
+
+func (rp RetentionPolicy) clauses() string {
+	replication := rp.Replication
+	if replication <= 0 {
+		replication = 1
+	}
+	clauses := fmt.Sprintf("DURATION %s REPLICATION %d", rp.Duration, replication)
+	if rp.ShardDuration != "" {
+		clauses += " SHARD DURATION " + rp.ShardDuration
+	}
+	if rp.Default {
+		clauses += " DEFAULT"
+	}
+	return clauses
+}
+
+// quoteIdent quotes an InfluxQL identifier.
+func quoteIdent(ident string) string {
+	ident = strings.ReplaceAll(ident, `\`, `\\`)
+	ident = strings.ReplaceAll(ident, `"`, `\"`)
+	return `"` + ident + `"`
+}
+
+// EnsureDatabase creates database on an InfluxDB 1.x server if it does not
+// exist, along with policies. Policies that already exist are altered to
+// match.
+func EnsureDatabase(ctx context.Context, httpConfig client.HTTPConfig, database string, policies []RetentionPolicy) error {
+	influxClient, err := client.NewHTTPClient(httpConfig)
+	if err != nil {
+		return err
+	}
+	defer influxClient.Close()
+
+	query := func(command string) error {
+		response, err := influxClient.QueryCtx(ctx, client.NewQuery(command, database, ""))
+		if err != nil {
+			return err
+		}
+		return response.Error()
+	}
+
+	// CREATE DATABASE is a no-op for a database that already exists
+	err = query("CREATE DATABASE " + quoteIdent(database))
+	if err != nil {
+		return fmt.Errorf("creating database %s: %w", database, err)
+	}
+	log.WithFields(log.Fields{
+		"database": database,
+	}).Info("ensured influxdb database exists")
+
+	for _, rp := range policies {
+		target := quoteIdent(rp.Name) + " ON " + quoteIdent(database) + " "
+		err = query("CREATE RETENTION POLICY " + target + rp.clauses())
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			err = query("ALTER RETENTION POLICY " + target + rp.clauses())
+		}
+		if err != nil {
+			return fmt.Errorf("creating retention policy %s: %w", rp.Name, err)
+		}
+		log.WithFields(log.Fields{
+			"database":         database,
+			"retention-policy": rp.Name,
+			"duration":         rp.Duration,
+			"default":          rp.Default,
+		}).Info("ensured influxdb retention policy exists")
+	}
+	return nil
+}
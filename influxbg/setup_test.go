@@ -0,0 +1,50 @@
+package influxbg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestEnsureDatabase(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" || r.Method != http.MethodPost {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "secret" {
+			t.Errorf("basic auth = %q, %q", user, pass)
+		}
+		q := r.URL.Query().Get("q")
+		queries = append(queries, q)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(q, `CREATE RETENTION POLICY "month"`) {
+			w.Write([]byte(`{"results":[{"statement_id":0,"error":"retention policy already exists"}]}`))
+			return
+		}
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer server.Close()
+
+	err := EnsureDatabase(context.Background(), client.HTTPConfig{Addr: server.URL, Username: "admin", Password: "secret"}, "gem", []RetentionPolicy{
+		{Name: "week", Duration: "7d"},
+		{Name: "month", Duration: "30d", Replication: 2, ShardDuration: "1d", Default: true},
+	})
+	if err != nil {
+		t.Fatalf("EnsureDatabase() error = %v", err)
+	}
+
+	want := []string{
+		`CREATE DATABASE "gem"`,
+		`CREATE RETENTION POLICY "week" ON "gem" DURATION 7d REPLICATION 1`,
+		`CREATE RETENTION POLICY "month" ON "gem" DURATION 30d REPLICATION 2 SHARD DURATION 1d DEFAULT`,
+		`ALTER RETENTION POLICY "month" ON "gem" DURATION 30d REPLICATION 2 SHARD DURATION 1d DEFAULT`,
+	}
+	if strings.Join(queries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("queries:\n%s\nwant:\n%s", strings.Join(queries, "\n"), strings.Join(want, "\n"))
+	}
+}
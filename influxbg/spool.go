@@ -0,0 +1,498 @@
+package influxbg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	log "github.com/sirupsen/logrus"
+)
+
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs the active segment after every append.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncRotate syncs a segment when it is closed.
+	FsyncRotate FsyncPolicy = "rotate"
+	// FsyncNever leaves syncing to the operating system.
+	FsyncNever FsyncPolicy = "never"
+)
+
+const (
+	defaultSegmentMaxBytes = 4 << 20
+	defaultSpoolMaxBytes   = 1 << 30
+	segmentSuffix          = ".lp"
+	// replayOffsetFile records how much of the oldest segment has been
+	// written back, as "<seq> <offset>", so that a restart resumes there.
+	replayOffsetFile = "replay.offset"
+)
+
+type SpoolConfig struct {
+	Dir string
+	// SegmentMaxBytes is the size at which the active segment is closed
+	// and a new one started; it is no more than MaxBytes.
+	SegmentMaxBytes int64
+	// MaxBytes caps the total size of the spool; the oldest segments are
+	// dropped once it is exceeded.
+	MaxBytes int64
+	// MaxAge drops segments older than this; zero keeps them forever.
+	MaxAge time.Duration
+	Fsync  FsyncPolicy
+}
+
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	created time.Time
+}
+
+// Spool is an on-disk write-ahead log of points that could not be written.
+// Points are stored as line protocol in numbered segment files so they
+// survive restarts and are replayed oldest first.
+type Spool struct {
+	config SpoolConfig
+
+	mu       sync.Mutex
+	segments []*segment
+	active   *os.File
+	replay   *replay
+}
+
+// replay is the read position in the oldest segment.
+type replay struct {
+	seq    uint64
+	file   *os.File
+	reader *bufio.Reader
+	// offset is the end of the points that have been written back, and
+	// read how far reader has got
+	offset int64
+	read   int64
+	// points have been read but not yet committed; ends holds the offset
+	// just past each of them
+	points []*client.Point
+	ends   []int64
+}
+
+func OpenSpool(config SpoolConfig) (*Spool, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("spool directory not set")
+	}
+	if config.SegmentMaxBytes <= 0 {
+		config.SegmentMaxBytes = defaultSegmentMaxBytes
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultSpoolMaxBytes
+	}
+	if config.SegmentMaxBytes > config.MaxBytes {
+		config.SegmentMaxBytes = config.MaxBytes
+	}
+	switch config.Fsync {
+	case "":
+		config.Fsync = FsyncRotate
+	case FsyncAlways, FsyncRotate, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", config.Fsync)
+	}
+
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{config: config}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() == 0 {
+			os.Remove(filepath.Join(config.Dir, name))
+			continue
+		}
+		s.segments = append(s.segments, &segment{
+			seq:     seq,
+			path:    filepath.Join(config.Dir, name),
+			size:    info.Size(),
+			created: info.ModTime(),
+		})
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	var offset int64
+	if len(s.segments) > 0 {
+		offset = s.readReplayOffset(s.segments[0].seq)
+	}
+	if offset > 0 {
+		s.replay = &replay{seq: s.segments[0].seq, offset: offset, read: offset}
+	} else {
+		os.Remove(filepath.Join(config.Dir, replayOffsetFile))
+	}
+
+	if len(s.segments) > 0 {
+		log.WithFields(log.Fields{
+			"dir":      config.Dir,
+			"segments": len(s.segments),
+			"bytes":    s.sizeLocked() - offset,
+		}).Info("found spooled points to replay")
+	}
+
+	return s, nil
+}
+
+// readReplayOffset returns how much of segment seq was written back
+// before the spool was last closed.
+func (s *Spool) readReplayOffset(seq uint64) int64 {
+	data, err := os.ReadFile(filepath.Join(s.config.Dir, replayOffsetFile))
+	if err != nil {
+		return 0
+	}
+	var offsetSeq uint64
+	var offset int64
+	_, err = fmt.Sscanf(string(data), "%d %d", &offsetSeq, &offset)
+	if err != nil || offsetSeq != seq || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// writeReplayOffsetLocked records the committed position in the oldest
+// segment, replacing the file so that it is never seen half written.
+func (s *Spool) writeReplayOffsetLocked() error {
+	path := filepath.Join(s.config.Dir, replayOffsetFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", s.replay.seq, s.replay.offset)
+	if err == nil && s.config.Fsync == FsyncAlways {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *Spool) sizeLocked() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// Empty reports whether there is nothing left to replay.
+func (s *Spool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizeLocked() == 0
+}
+
+// Size returns the number of bytes held in the spool.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizeLocked()
+}
+
+// Append writes points to the active segment.
+func (s *Spool) Append(points []*client.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	for _, point := range points {
+		buf.WriteString(point.String())
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireLocked()
+
+	if s.active == nil || s.segments[len(s.segments)-1].size >= s.config.SegmentMaxBytes {
+		err := s.rotateLocked()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.active.Write(buf.Bytes())
+	s.segments[len(s.segments)-1].size += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.config.Fsync == FsyncAlways {
+		err = s.active.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.enforceMaxBytesLocked()
+}
+
+// rotateLocked closes the active segment, if any, and starts a new one.
+func (s *Spool) rotateLocked() error {
+	err := s.closeActiveLocked()
+	if err != nil {
+		return err
+	}
+
+	var seq uint64 = 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	path := filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.segments = append(s.segments, &segment{
+		seq:     seq,
+		path:    path,
+		created: time.Now(),
+	})
+	return nil
+}
+
+func (s *Spool) closeActiveLocked() error {
+	if s.active == nil {
+		return nil
+	}
+	var err error
+	if s.config.Fsync != FsyncNever {
+		err = s.active.Sync()
+	}
+	if closeErr := s.active.Close(); err == nil {
+		err = closeErr
+	}
+	s.active = nil
+	return err
+}
+
+func (s *Spool) removeOldestLocked(reason string) {
+	oldest := s.segments[0]
+	if s.active != nil && len(s.segments) == 1 {
+		s.closeActiveLocked()
+	}
+	// the offset goes first so that it can never apply to a later segment
+	// given the same number
+	if s.replay != nil && s.replay.seq == oldest.seq {
+		if s.replay.file != nil {
+			s.replay.file.Close()
+		}
+		s.replay = nil
+		os.Remove(filepath.Join(s.config.Dir, replayOffsetFile))
+	}
+	err := os.Remove(oldest.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  oldest.path,
+		}).Error("unable to remove spool segment")
+	}
+	if reason != "" {
+		log.WithFields(log.Fields{
+			"path":   oldest.path,
+			"bytes":  oldest.size,
+			"reason": reason,
+		}).Warn("dropping spooled points")
+	}
+	s.segments = s.segments[1:]
+}
+
+func (s *Spool) expireLocked() {
+	if s.config.MaxAge <= 0 {
+		return
+	}
+	for len(s.segments) > 0 && time.Since(s.segments[0].created) > s.config.MaxAge {
+		s.removeOldestLocked("segment older than max age")
+	}
+}
+
+// enforceMaxBytesLocked drops the oldest segments until the spool fits in
+// MaxBytes, starting a new segment first if the active one is all there
+// is.
+func (s *Spool) enforceMaxBytesLocked() error {
+	for len(s.segments) > 0 && s.sizeLocked() > s.config.MaxBytes {
+		if s.active != nil && len(s.segments) == 1 {
+			err := s.rotateLocked()
+			if err != nil {
+				return err
+			}
+		}
+		s.removeOldestLocked("spool larger than max bytes")
+	}
+	return nil
+}
+
+// Next returns up to max points from the oldest segment, in the order they
+// were spooled. Call Commit once they have been written; until then Next
+// returns the same points again.
+func (s *Spool) Next(max int) ([]*client.Point, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireLocked()
+
+	for len(s.segments) > 0 {
+		oldest := s.segments[0]
+		if oldest.size == 0 {
+			if s.active != nil && len(s.segments) == 1 {
+				return nil, nil
+			}
+			s.removeOldestLocked("")
+			continue
+		}
+		if s.active != nil && len(s.segments) == 1 {
+			// replay from a closed segment so appends go elsewhere
+			err := s.rotateLocked()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := s.readLocked(oldest, max)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"path":  oldest.path,
+			}).Error("unable to read spool segment")
+			s.removeOldestLocked("unreadable segment")
+			continue
+		}
+
+		points := s.replay.points
+		if len(points) == 0 {
+			// every point of the segment has been written back
+			s.removeOldestLocked("")
+			continue
+		}
+		if max > 0 && len(points) > max {
+			points = points[:max]
+		}
+		return points, nil
+	}
+	return nil, nil
+}
+
+// readLocked reads points from oldest until max are waiting to be
+// committed or the segment ends, opening it where replay last got to.
+func (s *Spool) readLocked(oldest *segment, max int) error {
+	if s.replay == nil || s.replay.seq != oldest.seq {
+		s.replay = &replay{seq: oldest.seq}
+	}
+	r := s.replay
+	if r.file == nil {
+		f, err := os.Open(oldest.path)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(r.offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r.file = f
+		r.reader = bufio.NewReader(f)
+		r.read = r.offset
+		r.points, r.ends = nil, nil
+	}
+
+	for max <= 0 || len(r.points) < max {
+		line, err := r.reader.ReadBytes('\n')
+		r.read += int64(len(line))
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			parsed, parseErr := models.ParsePoints(line)
+			if parseErr != nil {
+				// most likely a torn write at the end of the segment
+				log.WithFields(log.Fields{
+					"error": parseErr,
+					"path":  oldest.path,
+				}).Warn("skipping unparseable spooled point")
+			}
+			for _, point := range parsed {
+				r.points = append(r.points, client.NewPointFrom(point))
+				r.ends = append(r.ends, r.read)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit marks n points returned by Next as written.
+func (s *Spool) Commit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.replay
+	if r == nil || n <= 0 {
+		return
+	}
+	if n > len(r.points) {
+		n = len(r.points)
+	}
+	r.offset = r.ends[n-1]
+	r.points = r.points[n:]
+	r.ends = r.ends[n:]
+
+	err := s.writeReplayOffsetLocked()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"dir":   s.config.Dir,
+		}).Error("unable to record spool replay offset")
+	}
+}
+
+// Close syncs and closes the active segment.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replay != nil && s.replay.file != nil {
+		s.replay.file.Close()
+		s.replay.file = nil
+	}
+	return s.closeActiveLocked()
+}
@@ -0,0 +1,222 @@
+package influxbg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func testPoints(t *testing.T, start, n int) []*client.Point {
+	t.Helper()
+	points := make([]*client.Point, n)
+	for i := range points {
+		point, err := client.NewPoint("energy", map[string]string{"channel": "1"}, map[string]interface{}{"watts": float64(start + i)}, time.Unix(int64(start+i), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		points[i] = point
+	}
+	return points
+}
+
+func watts(t *testing.T, points []*client.Point) []float64 {
+	t.Helper()
+	var values []float64
+	for _, point := range points {
+		fields, err := point.Fields()
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, fields["watts"].(float64))
+	}
+	return values
+}
+
+func TestSpoolReplaysInOrderAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	config := SpoolConfig{Dir: dir, SegmentMaxBytes: 200, Fsync: FsyncAlways}
+
+	spool, err := OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := spool.Append(testPoints(t, i*4, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err = OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if spool.Empty() {
+		t.Fatal("spool is empty after reopening")
+	}
+
+	// points appended after the restart are replayed after the old ones
+	if err := spool.Append(testPoints(t, 20, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []float64
+	for !spool.Empty() {
+		points, err := spool.Next(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) == 0 {
+			break
+		}
+		replayed = append(replayed, watts(t, points)...)
+		spool.Commit(len(points))
+	}
+
+	if len(replayed) != 22 {
+		t.Fatalf("replayed %d points, want 22: %v", len(replayed), replayed)
+	}
+	for i, value := range replayed {
+		if value != float64(i) {
+			t.Fatalf("replayed out of order: %v", replayed)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		info, _ := entry.Info()
+		if info.Size() != 0 {
+			t.Errorf("segment %s left behind after replay", entry.Name())
+		}
+	}
+}
+
+func TestSpoolUncommittedPointsAreReplayedAgain(t *testing.T) {
+	spool, err := OpenSpool(SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	if err := spool.Append(testPoints(t, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := spool.Next(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := spool.Next(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(watts(t, first)) != fmt.Sprint(watts(t, again)) {
+		t.Errorf("Next() without Commit returned %v then %v", watts(t, first), watts(t, again))
+	}
+}
+
+func TestSpoolMaxBytesDropsOldestSegments(t *testing.T) {
+	spool, err := OpenSpool(SpoolConfig{Dir: t.TempDir(), SegmentMaxBytes: 100, MaxBytes: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := spool.Append(testPoints(t, i*2, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := spool.Size(); size > 300 {
+		t.Errorf("spool size %d exceeds cap", size)
+	}
+
+	points, err := spool.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := watts(t, points); len(got) != 1 || got[0] == 0 {
+		t.Errorf("oldest points were not dropped, next = %v", got)
+	}
+}
+
+func TestSpoolMaxBytesCapsActiveSegment(t *testing.T) {
+	spool, err := OpenSpool(SpoolConfig{Dir: t.TempDir(), SegmentMaxBytes: 1 << 20, MaxBytes: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := spool.Append(testPoints(t, i*2, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if size := spool.Size(); size > 300 {
+			t.Fatalf("spool size %d exceeds cap after %d appends", size, i+1)
+		}
+	}
+	if spool.Empty() {
+		t.Error("spool dropped everything")
+	}
+}
+
+func TestSpoolResumesReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	config := SpoolConfig{Dir: dir, Fsync: FsyncAlways}
+
+	spool, err := OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(testPoints(t, 0, 10)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		points, err := spool.Next(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spool.Commit(len(points))
+	}
+	// read but never committed
+	if _, err := spool.Next(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err = OpenSpool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	var replayed []float64
+	for !spool.Empty() {
+		points, err := spool.Next(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) == 0 {
+			break
+		}
+		replayed = append(replayed, watts(t, points)...)
+		spool.Commit(len(points))
+	}
+	if fmt.Sprint(replayed) != fmt.Sprint([]float64{6, 7, 8, 9}) {
+		t.Errorf("replayed %v after restart, want 6 to 9", replayed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, replayOffsetFile)); !os.IsNotExist(err) {
+		t.Errorf("replay offset left behind: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/influxbg"
+	"github.com/influxdata/influxdb/client/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// InfluxDBConfig describes where and how points are written. For backwards
+// compatibility it may also be given as a plain URL string.
+type InfluxDBConfig struct {
+	Address string `json:"address"`
+	// Version selects the write API: 1 (the default) for InfluxDB 1.x, or
+	// 2 or 3 for the /api/v2/write API served by InfluxDB 2.x and 3.x.
+	Version int `json:"version"`
+	// Database is the 1.x database, "gem" by default.
+	Database string `json:"database"`
+	// Username and Password authenticate to InfluxDB 1.x.
+	Username string `json:"username"`
+	Password Secret `json:"password"`
+	// Org, Bucket and Token address the 2.x API. InfluxDB 3.x takes the
+	// database name as the bucket and needs no org.
+	Org    string     `json:"org"`
+	Bucket string     `json:"bucket"`
+	Token  Secret     `json:"token"`
+	TLS    *TLSConfig `json:"tls"`
+	// Proxy is the URL of an HTTP proxy to connect through, or
+	// "environment" to use HTTP_PROXY and friends.
+	Proxy string `json:"proxy"`
+	// MaxBodyBytes caps the uncompressed size of a write request; batches
+	// shrink below it automatically if InfluxDB or a proxy rejects them.
+	MaxBodyBytes int `json:"max_body_bytes"`
+	// DisableCompression sends write requests without gzip.
+	DisableCompression bool `json:"disable_compression"`
+	// Timeout bounds a single write request.
+	Timeout Duration `json:"timeout"`
+	// ConnectTimeout bounds establishing a connection.
+	ConnectTimeout Duration `json:"connect_timeout"`
+	// Precision is the timestamp precision, one of "s", "ms" (the
+	// default), "us" or "ns".
+	Precision string `json:"precision"`
+	// DeadLetter is a file that points InfluxDB refuses, such as for a
+	// field type conflict, are appended to as JSON lines.
+	DeadLetter string `json:"dead_letter"`
+	// CreateDatabase creates the 1.x database and RetentionPolicies at
+	// startup.
+	CreateDatabase    bool                    `json:"create_database"`
+	RetentionPolicies []RetentionPolicyConfig `json:"retention_policies"`
+}
+
+// TLSConfig configures connections to an https InfluxDB address.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of certificate authorities to trust instead
+	// of the system pool.
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are a client certificate to present.
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// RetentionPolicyConfig is created by CreateDatabase. Durations are
+// InfluxQL duration literals such as "30d" or "INF".
+type RetentionPolicyConfig struct {
+	Name          string `json:"name"`
+	Duration      string `json:"duration"`
+	Replication   int    `json:"replication"`
+	ShardDuration string `json:"shard_duration"`
+	// Default makes this the policy points are written to.
+	Default bool `json:"default"`
+}
+
+func (i *InfluxDBConfig) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*i = InfluxDBConfig{Address: address}
+		return nil
+	}
+
+	type plain InfluxDBConfig
+	return json.Unmarshal(data, (*plain)(i))
+}
+
+func (i *InfluxDBConfig) Validate() error {
+	if i.Address == "" {
+		return fmt.Errorf("missing address")
+	}
+	switch i.Version {
+	case 0, 1:
+		if i.Org != "" || i.Bucket != "" || !i.Token.IsZero() {
+			return fmt.Errorf("org, bucket and token need version 2 or 3")
+		}
+	case 2, 3:
+		if i.Bucket == "" {
+			return fmt.Errorf("missing bucket")
+		}
+		if i.Database != "" {
+			return fmt.Errorf("database is only used by version 1, use bucket")
+		}
+		if i.CreateDatabase || len(i.RetentionPolicies) > 0 {
+			return fmt.Errorf("create_database and retention_policies need version 1")
+		}
+	default:
+		return fmt.Errorf("unknown version %d", i.Version)
+	}
+	if i.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	switch i.Precision {
+	case "", "s", "ms", "us", "ns":
+	default:
+		return fmt.Errorf("unknown precision %q", i.Precision)
+	}
+	if i.Proxy != "" && i.Proxy != "environment" {
+		_, err := url.Parse(i.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy: %w", err)
+		}
+	}
+	if i.TLS != nil && (i.TLS.CertFile == "") != (i.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file must be set together")
+	}
+	if len(i.RetentionPolicies) > 0 && !i.CreateDatabase {
+		return fmt.Errorf("retention_policies need create_database")
+	}
+	defaults := 0
+	for _, rp := range i.RetentionPolicies {
+		if rp.Name == "" || rp.Duration == "" {
+			return fmt.Errorf("retention policy needs a name and duration")
+		}
+		if rp.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("only one retention policy can be the default")
+	}
+	return nil
+}
+
+func (i *InfluxDBConfig) database() string {
+	if i.Database == "" {
+		return "gem"
+	}
+	return i.Database
+}
+
+func (t *TLSConfig) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// httpConfig builds the client configuration, reading any secrets and
+// certificates from disk.
+func (i *InfluxDBConfig) httpConfig() (client.HTTPConfig, error) {
+	password, err := i.Password.Resolve()
+	if err != nil {
+		return client.HTTPConfig{}, fmt.Errorf("password: %w", err)
+	}
+
+	httpConfig := client.HTTPConfig{
+		Addr:     i.Address,
+		Username: i.Username,
+		Password: password,
+		Timeout:  time.Duration(i.Timeout),
+	}
+
+	if i.TLS != nil {
+		httpConfig.TLSConfig, err = i.TLS.config()
+		if err != nil {
+			return client.HTTPConfig{}, fmt.Errorf("tls: %w", err)
+		}
+		httpConfig.InsecureSkipVerify = i.TLS.InsecureSkipVerify
+	}
+
+	switch i.Proxy {
+	case "":
+	case "environment":
+		httpConfig.Proxy = http.ProxyFromEnvironment
+	default:
+		proxy, err := url.Parse(i.Proxy)
+		if err != nil {
+			return client.HTTPConfig{}, fmt.Errorf("proxy: %w", err)
+		}
+		httpConfig.Proxy = http.ProxyURL(proxy)
+	}
+
+	if i.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: time.Duration(i.ConnectTimeout)}
+		httpConfig.DialContext = dialer.DialContext
+	}
+
+	return httpConfig, nil
+}
+
+// newWriter returns a writer for the configured InfluxDB version.
+func (i *InfluxDBConfig) newWriter(spool *SpoolConfig) (*influxbg.InfluxBGWriter, error) {
+	httpConfig, err := i.httpConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	options := influxbg.Options{
+		MaxBodyBytes:       i.MaxBodyBytes,
+		DisableCompression: i.DisableCompression,
+		DeadLetter:         i.DeadLetter,
+		Precision:          i.Precision,
+	}
+	if spool != nil {
+		options.Spool = spool.influxbg()
+	}
+
+	if i.Version >= 2 {
+		token, err := i.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("token: %w", err)
+		}
+		return influxbg.NewInfluxV2BGWriter(httpConfig, influxbg.V2Target{
+			Org:    i.Org,
+			Bucket: i.Bucket,
+			Token:  token,
+		}, options)
+	}
+	return influxbg.NewInfluxBGWriterWithOptions(httpConfig, i.database(), options)
+}
+
+// ensureDatabase creates the database and retention policies, retrying
+// until it succeeds or ctx is cancelled.
+func (i *InfluxDBConfig) ensureDatabase(ctx context.Context) error {
+	httpConfig, err := i.httpConfig()
+	if err != nil {
+		return err
+	}
+
+	var policies []influxbg.RetentionPolicy
+	for _, rp := range i.RetentionPolicies {
+		policies = append(policies, influxbg.RetentionPolicy{
+			Name:          rp.Name,
+			Duration:      rp.Duration,
+			Replication:   rp.Replication,
+			ShardDuration: rp.ShardDuration,
+			Default:       rp.Default,
+		})
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = influxbg.EnsureDatabase(ctx, httpConfig, i.database(), policies)
+		if err == nil {
+			return nil
+		}
+
+		delay := backoff(attempt)
+		log.WithFields(log.Fields{
+			"error":    err,
+			"address":  i.Address,
+			"database": i.database(),
+			"backoff":  delay,
+		}).Error("unable to create influxdb database, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxDBConfigTLSAndAuth(t *testing.T) {
+	var user, pass string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BRUL2INFLUX_TEST_PASSWORD", "hunter2")
+
+	var config InfluxDBConfig
+	err := json.Unmarshal([]byte(`{
+		"address": "`+server.URL+`",
+		"username": "gem",
+		"password": {"env": "BRUL2INFLUX_TEST_PASSWORD"},
+		"tls": {"ca_file": "`+caFile+`"}
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	writer, err := config.newWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write("voltage", nil, map[string]interface{}{"volts": 120.0}, time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := writer.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if user != "gem" || pass != "hunter2" {
+		t.Errorf("basic auth = %q, %q", user, pass)
+	}
+}
+
+func TestInfluxDBConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  InfluxDBConfig
+		wantErr bool
+	}{
+		{name: "plain address", config: InfluxDBConfig{Address: "http://influxdb:8086"}},
+		{name: "missing address", config: InfluxDBConfig{}, wantErr: true},
+		{name: "v2", config: InfluxDBConfig{Address: "http://influxdb:8086", Version: 2, Org: "home", Bucket: "gem"}},
+		{name: "v2 without bucket", config: InfluxDBConfig{Address: "http://influxdb:8086", Version: 2}, wantErr: true},
+		{name: "token on v1", config: InfluxDBConfig{Address: "http://influxdb:8086", Token: Secret{Value: "x"}}, wantErr: true},
+		{name: "cert without key", config: InfluxDBConfig{Address: "https://influxdb:8086", TLS: &TLSConfig{CertFile: "cert.pem"}}, wantErr: true},
+		{
+			name: "retention policies",
+			config: InfluxDBConfig{Address: "http://influxdb:8086", CreateDatabase: true, RetentionPolicies: []RetentionPolicyConfig{
+				{Name: "week", Duration: "7d", Default: true},
+			}},
+		},
+		{
+			name: "two default retention policies",
+			config: InfluxDBConfig{Address: "http://influxdb:8086", CreateDatabase: true, RetentionPolicies: []RetentionPolicyConfig{
+				{Name: "week", Duration: "7d", Default: true},
+				{Name: "month", Duration: "30d", Default: true},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "retention policies without create_database",
+			config: InfluxDBConfig{Address: "http://influxdb:8086", RetentionPolicies: []RetentionPolicyConfig{
+				{Name: "week", Duration: "7d"},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInfluxDBConfigWritesOnceDatabaseExists(t *testing.T) {
+	var mu sync.Mutex
+	created := false
+	refused := make(chan struct{})
+	var refusedOnce sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/query":
+			if strings.HasPrefix(r.FormValue("q"), "CREATE DATABASE") {
+				created = true
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+		case "/write":
+			if !created {
+				refusedOnce.Do(func() { close(refused) })
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":"database not found: \"gem\""}`)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	config := InfluxDBConfig{Address: server.URL, CreateDatabase: true}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := config.newWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		writer.Write("voltage", nil, map[string]interface{}{"volts": float64(i)}, time.Unix(int64(i), 0))
+	}
+
+	// the writer gets ahead of creating the database
+	select {
+	case <-refused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer did not write before the database existed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := config.ensureDatabase(ctx); err != nil {
+		t.Fatalf("ensureDatabase() error = %v", err)
+	}
+
+	if err := writer.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if stats := writer.Stats(); stats.Written != 10 || stats.Rejected != 0 || stats.Dropped != 0 {
+		t.Errorf("stats = %+v, want all 10 written once the database exists", stats)
+	}
+}
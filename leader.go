@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// LeaderElectionConfig makes replicas elect a leader with a Kubernetes
+// Lease so that only one of them collects from the configured hosts,
+// accepts packets on the listener and HTTP ingest, publishes to MQTT and
+// writes self metrics. The others keep running, with their other servers
+// up, and take over when the leader stops renewing the lease.
+type LeaderElectionConfig struct {
+	// Name of the Lease, which defaults to "brul2influx".
+	Name string `json:"name"`
+	// Namespace of the Lease, which defaults to the pod's.
+	Namespace string `json:"namespace"`
+	// Identity of this replica, which defaults to the hostname, which is
+	// the pod's name.
+	Identity string `json:"identity"`
+	// LeaseDuration is how long followers wait after the last renewal
+	// before taking over; it defaults to 15s.
+	LeaseDuration Duration `json:"lease_duration"`
+	// RenewDeadline is how long the leader keeps trying to renew before
+	// it stops collecting; it defaults to 10s.
+	RenewDeadline Duration `json:"renew_deadline"`
+	// RetryPeriod is how often the lease is renewed or tried for; it
+	// defaults to 2s.
+	RetryPeriod Duration `json:"retry_period"`
+}
+
+func (l *LeaderElectionConfig) name() string {
+	if l.Name == "" {
+		return "brul2influx"
+	}
+	return l.Name
+}
+
+func (l *LeaderElectionConfig) leaseDuration() time.Duration {
+	if l.LeaseDuration == 0 {
+		return defaultLeaseDuration
+	}
+	return time.Duration(l.LeaseDuration)
+}
+
+func (l *LeaderElectionConfig) renewDeadline() time.Duration {
+	if l.RenewDeadline == 0 {
+		return defaultRenewDeadline
+	}
+	return time.Duration(l.RenewDeadline)
+}
+
+func (l *LeaderElectionConfig) retryPeriod() time.Duration {
+	if l.RetryPeriod == 0 {
+		return defaultRetryPeriod
+	}
+	return time.Duration(l.RetryPeriod)
+}
+
+func (l *LeaderElectionConfig) Validate() error {
+	if l.LeaseDuration < 0 || l.RenewDeadline < 0 || l.RetryPeriod < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	if l.leaseDuration() < time.Second {
+		return fmt.Errorf("lease_duration must be at least 1s")
+	}
+	if l.renewDeadline() >= l.leaseDuration() {
+		return fmt.Errorf("renew_deadline must be shorter than lease_duration")
+	}
+	// client-go adds up to this much jitter to the retry period
+	if float64(l.retryPeriod())*leaderelection.JitterFactor >= float64(l.renewDeadline()) {
+		return fmt.Errorf("retry_period must be shorter than renew_deadline by %gx", leaderelection.JitterFactor)
+	}
+	return nil
+}
+
+// LeaderElector holds a Lease while this replica is the leader.
+type LeaderElector struct {
+	config    *LeaderElectionConfig
+	client    kubernetes.Interface
+	namespace string
+	identity  string
+
+	// leading is held while lead runs, so that it never runs twice at
+	// once: client-go does not wait for it to return when the lease is
+	// lost
+	leading sync.Mutex
+}
+
+// NewLeaderElector returns an elector for config that uses the pod's
+// service account.
+func NewLeaderElector(config *LeaderElectionConfig) (*LeaderElector, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	namespace := config.Namespace
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("unable to find namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	identity := config.Identity
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newLeaderElector(config, client, namespace, identity), nil
+}
+
+func newLeaderElector(config *LeaderElectionConfig, client kubernetes.Interface, namespace, identity string) *LeaderElector {
+	return &LeaderElector{
+		config:    config,
+		client:    client,
+		namespace: namespace,
+		identity:  identity,
+	}
+}
+
+// Run calls lead while this replica holds the lease, cancelling the
+// context it is given when the lease is lost, until ctx is cancelled.
+// The lease is then released so that another replica takes over
+// immediately, and Run returns once lead has.
+func (e *LeaderElector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      e.config.name(),
+			Namespace: e.namespace,
+		},
+		Client: e.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: e.identity,
+		},
+	}
+	fields := log.Fields{
+		"identity": e.identity,
+		"lease":    e.config.name(),
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			Name:            e.config.name(),
+			LeaseDuration:   e.config.leaseDuration(),
+			RenewDeadline:   e.config.renewDeadline(),
+			RetryPeriod:     e.config.retryPeriod(),
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					e.leading.Lock()
+					defer e.leading.Unlock()
+					// the lease may have been lost while the previous
+					// term was still stopping
+					if ctx.Err() != nil {
+						return
+					}
+					log.WithFields(fields).Info("became leader")
+					lead(ctx)
+				},
+				OnStoppedLeading: func() {
+					if ctx.Err() == nil {
+						log.WithFields(fields).Error("lost leadership")
+					}
+				},
+				OnNewLeader: func(identity string) {
+					if identity != e.identity {
+						log.WithFields(fields).WithField("leader", identity).Info("following leader")
+					}
+				},
+			},
+		})
+	}
+
+	e.leading.Lock()
+	defer e.leading.Unlock()
+}
+
+// leaderTasks are what only the leader runs when leader election is
+// configured, so that replicas neither write points twice nor publish
+// over each other: the collectors, the listener, HTTP ingest, the MQTT
+// publisher and self metrics.
+type leaderTasks struct {
+	tasks   []func(ctx context.Context)
+	leading atomic.Bool
+}
+
+// newLeaderTasks sets up the tasks for config, writing packets to writers.
+// publisher and self are only run if configured.
+func newLeaderTasks(config *Config, collectors *collectorSet, writers PointWriter, publisher *MQTTPublisher, self *selfMetrics) (*leaderTasks, error) {
+	t := &leaderTasks{}
+	t.add(collectors.Run)
+
+	if config.Listen != nil {
+		listener, err := NewListener(config.Listen, writers)
+		if err != nil {
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+		t.add(func(ctx context.Context) {
+			err := listener.Run(ctx)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"address": config.Listen.Address,
+				}).Error("listener failed")
+			}
+		})
+	}
+
+	if config.HTTP != nil {
+		ingest := NewHTTPIngest(config.HTTP, func(packet *gem.Packet, remote string) {
+			handlePacket(writers, &HostConfig{
+				Address:        remote,
+				SecondsCounter: config.HTTP.SecondsCounter,
+				Timestamps:     config.HTTP.Timestamps,
+			}, packet, time.Now())
+		})
+		t.add(func(ctx context.Context) {
+			err := ingest.Serve(ctx, config.HTTP)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"address": config.HTTP.Address,
+				}).Error("HTTP ingest server failed")
+			}
+		})
+	}
+
+	if publisher != nil {
+		t.add(func(ctx context.Context) {
+			err := publisher.Run(ctx)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error":   err,
+					"address": config.MQTT.Address,
+				}).Error("mqtt publisher failed")
+			}
+		})
+	}
+
+	if config.SelfMetrics != nil {
+		t.add(func(ctx context.Context) {
+			self.run(ctx, self.writer, config.SelfMetrics.interval())
+		})
+	}
+	return t, nil
+}
+
+func (t *leaderTasks) add(task func(ctx context.Context)) {
+	t.tasks = append(t.tasks, task)
+}
+
+// Run runs every task until ctx is cancelled.
+func (t *leaderTasks) Run(ctx context.Context) {
+	t.leading.Store(true)
+	defer t.leading.Store(false)
+
+	wg := &sync.WaitGroup{}
+	for _, task := range t.tasks {
+		wg.Add(1)
+		go func(task func(ctx context.Context)) {
+			defer wg.Done()
+			task(ctx)
+		}(task)
+	}
+	wg.Wait()
+}
+
+// Leading reports whether the tasks are running.
+func (t *leaderTasks) Leading() bool {
+	return t.leading.Load()
+}
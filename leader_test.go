@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// blockedLeases fails updates to leases made by blocked identities, as if
+// they could not reach the API server.
+type blockedLeases struct {
+	mu      sync.Mutex
+	blocked map[string]bool
+}
+
+func (b *blockedLeases) react(action k8stesting.Action) (bool, runtime.Object, error) {
+	update, ok := action.(k8stesting.UpdateAction)
+	if !ok {
+		return false, nil, nil
+	}
+	lease, ok := update.GetObject().(*coordinationv1.Lease)
+	if !ok || lease.Spec.HolderIdentity == nil {
+		return false, nil, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.blocked[*lease.Spec.HolderIdentity] {
+		return true, nil, fmt.Errorf("%s can not reach the API server", *lease.Spec.HolderIdentity)
+	}
+	return false, nil, nil
+}
+
+func (b *blockedLeases) block(identity string, blocked bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked[identity] = blocked
+}
+
+func TestLeaderElection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	blocked := &blockedLeases{blocked: make(map[string]bool)}
+	client.PrependReactor("update", "leases", blocked.react)
+
+	config := &LeaderElectionConfig{
+		LeaseDuration: Duration(2 * time.Second),
+		RenewDeadline: Duration(500 * time.Millisecond),
+		RetryPeriod:   Duration(50 * time.Millisecond),
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan string, 10)
+	run := func(identity string) (context.CancelFunc, chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		elector := newLeaderElector(config, client, "test", identity)
+		go func() {
+			defer close(done)
+			elector.Run(ctx, func(ctx context.Context) {
+				events <- identity + " leading"
+				<-ctx.Done()
+				events <- identity + " stopped"
+			})
+		}()
+		return cancel, done
+	}
+	expect := func(want string, within time.Duration) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(within):
+			t.Fatalf("no %q within %s", want, within)
+		}
+	}
+
+	cancelA, doneA := run("a")
+	expect("a leading", time.Second)
+	cancelB, doneB := run("b")
+	select {
+	case got := <-events:
+		t.Fatalf("got %q while a holds the lease", got)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// a can not renew, so stops leading before b can take over
+	blocked.block("a", true)
+	expect("a stopped", time.Second)
+	expect("b leading", 5*time.Second)
+	blocked.block("a", false)
+
+	// b releases the lease when it shuts down, so a takes over well
+	// before it would have expired
+	cancelB()
+	expect("b stopped", time.Second)
+	<-doneB
+	expect("a leading", time.Second)
+
+	cancelA()
+	expect("a stopped", time.Second)
+	<-doneA
+	lease, err := client.CoordinationV1().Leases("test").Get(context.Background(), "brul2influx", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != "" {
+		t.Errorf("lease is held by %q after shutting down", *holder)
+	}
+	if transitions := lease.Spec.LeaseTransitions; transitions == nil || *transitions != 2 {
+		t.Errorf("lease transitions = %v, want 2", transitions)
+	}
+}
+
+// accepting reports whether anything is listening on address.
+func accepting(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestFollowerDoesNotAcceptPackets(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	election := &LeaderElectionConfig{
+		LeaseDuration: Duration(2 * time.Second),
+		RenewDeadline: Duration(500 * time.Millisecond),
+		RetryPeriod:   Duration(50 * time.Millisecond),
+	}
+
+	// another replica holds the lease
+	leaderCtx, stopLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	leading := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		newLeaderElector(election, client, "test", "leader").Run(leaderCtx, func(ctx context.Context) {
+			close(leading)
+			<-ctx.Done()
+		})
+	}()
+	defer func() {
+		stopLeader()
+		<-leaderDone
+	}()
+	select {
+	case <-leading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leader was not elected")
+	}
+
+	config := &Config{
+		Listen: &ListenConfig{Address: freeAddress(t), Format: "ascii"},
+		HTTP:   &HTTPIngestConfig{Address: freeAddress(t)},
+	}
+	writer := &recordingWriter{}
+	tasks, err := newLeaderTasks(config, newCollectorSet(writer), writer, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newLeaderElector(election, client, "test", "follower").Run(ctx, tasks.Run)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	if tasks.Leading() {
+		t.Fatal("follower is leading")
+	}
+	for _, address := range []string{config.Listen.Address, config.HTTP.Address} {
+		if accepting(address) {
+			t.Errorf("follower is accepting connections on %s", address)
+		}
+	}
+
+	// until the leader steps down
+	stopLeader()
+	<-leaderDone
+	deadline := time.Now().Add(5 * time.Second)
+	for !tasks.Leading() || !accepting(config.Listen.Address) || !accepting(config.HTTP.Address) {
+		if time.Now().After(deadline) {
+			t.Fatal("follower did not take over the listener and HTTP ingest")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
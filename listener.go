@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	log "github.com/sirupsen/logrus"
+)
+
+// ListenConfig configures the listener that accepts connections from GEMs
+// set up to push packets to a server.
+type ListenConfig struct {
+	Address string `json:"address"`
+	// Allow optionally restricts which addresses may connect; entries are
+	// IP addresses or CIDR ranges.
+	Allow []string `json:"allow"`
+	// Format is one of "ascii", "binary" or "auto" (the default).
+	Format            string   `json:"format"`
+	InactivityTimeout Duration `json:"inactivity_timeout"`
+	// SecondsCounter writes each device's seconds counter; see
+	// HostConfig.SecondsCounter.
+	SecondsCounter bool `json:"seconds_counter"`
+	// Timestamps is "device" (the default) or "received"; see
+	// HostConfig.Timestamps.
+	Timestamps string `json:"timestamps"`
+}
+
+func parseAllowList(allow []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range allow {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q in allow list", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in allow list: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Listener accepts inbound connections from GEMs and feeds their packets
+// through the same decode and write path as dialed hosts. Devices are
+// identified by the serial number in their packets, so a device that
+// reconnects replaces its previous connection.
+type Listener struct {
+	config *ListenConfig
+	ibgw   PointWriter
+	allow  []*net.IPNet
+
+	mu      sync.Mutex
+	devices map[string]net.Conn
+}
+
+func NewListener(config *ListenConfig, ibgw PointWriter) (*Listener, error) {
+	allow, err := parseAllowList(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		config:  config,
+		ibgw:    ibgw,
+		allow:   allow,
+		devices: make(map[string]net.Conn),
+	}, nil
+}
+
+func (l *Listener) allowed(addr net.Addr) bool {
+	if len(l.allow) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.allow {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run accepts connections until ctx is cancelled.
+func (l *Listener) Run(ctx context.Context) error {
+	lc := &net.ListenConfig{}
+	ln, err := lc.Listen(ctx, "tcp", l.config.Address)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"address": ln.Addr().String(),
+	}).Info("listening for GEM connections")
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !l.allowed(conn.RemoteAddr()) {
+			log.WithFields(log.Fields{
+				"remote": conn.RemoteAddr().String(),
+			}).Warn("rejected connection from address not in allow list")
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.serve(ctx, conn)
+		}()
+	}
+}
+
+func (l *Listener) serve(ctx context.Context, conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	log.WithFields(log.Fields{
+		"remote": remote,
+	}).Info("accepted GEM connection")
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		conn.Close()
+	}()
+
+	hostConfig := &HostConfig{
+		Address:           remote,
+		Format:            l.config.Format,
+		InactivityTimeout: l.config.InactivityTimeout,
+		SecondsCounter:    l.config.SecondsCounter,
+		Timestamps:        l.config.Timestamps,
+	}
+
+	var reader io.Reader = conn
+	if timeout := hostConfig.inactivityTimeout(); timeout > 0 {
+		reader = &deadlineReader{conn: conn, timeout: timeout}
+	}
+
+	var serial string
+	err := readPackets(hostConfig, bufio.NewReader(reader), sources.remoteSource(remote), func(packet *gem.Packet) {
+		if packet.Serial != serial && packet.Serial != "" {
+			serial = packet.Serial
+			l.identify(serial, conn)
+		}
+		handlePacket(l.ibgw, hostConfig, packet, time.Now())
+	})
+
+	if serial != "" {
+		l.forget(serial, conn)
+	}
+
+	log.WithFields(log.Fields{
+		"error":  err,
+		"remote": remote,
+		"serial": serial,
+	}).Info("GEM connection closed")
+}
+
+// identify records that conn carries packets for serial, closing any older
+// connection from the same device.
+func (l *Listener) identify(serial string, conn net.Conn) {
+	l.mu.Lock()
+	previous := l.devices[serial]
+	l.devices[serial] = conn
+	l.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"remote": conn.RemoteAddr().String(),
+		"serial": serial,
+	}).Info("identified GEM connection")
+
+	if previous != nil && previous != conn {
+		log.WithFields(log.Fields{
+			"remote": previous.RemoteAddr().String(),
+			"serial": serial,
+		}).Info("closing stale connection for device")
+		previous.Close()
+	}
+}
+
+func (l *Listener) forget(serial string, conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.devices[serial] == conn {
+		delete(l.devices, serial)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a local address nothing is listening on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// runListener starts a listener for config until the test ends.
+func runListener(t *testing.T, config *ListenConfig, writer PointWriter) *Listener {
+	t.Helper()
+	config.Address = freeAddress(t)
+	listener, err := NewListener(config, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := listener.Run(ctx); err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener
+}
+
+func dialListener(t *testing.T, listener *Listener) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", listener.config.Address)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// device returns the connection the listener holds for serial.
+func (l *Listener) device(serial string) net.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.devices[serial]
+}
+
+func waitForDevice(t *testing.T, listener *Listener, serial string, want net.Conn) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn := listener.device(serial)
+		if conn != nil && conn.RemoteAddr().String() == want.LocalAddr().String() {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not identified on %s", serial, want.LocalAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenerRejectsAddressesNotAllowed(t *testing.T) {
+	writer := &recordingWriter{}
+	listener := runListener(t, &ListenConfig{Allow: []string{"10.0.0.1"}, Format: "ascii"}, writer)
+
+	conn := dialListener(t, listener)
+	conn.Write([]byte("n=01000123&v=120.5&p_1=100\r\n"))
+	if !closed(conn) {
+		t.Error("connection from an address not in the allow list is still open")
+	}
+	if _, ok := writer.find("energy"); ok {
+		t.Error("wrote points from a rejected connection")
+	}
+}
+
+func TestListenerIdentifiesDevices(t *testing.T) {
+	writer := &recordingWriter{}
+	listener := runListener(t, &ListenConfig{Allow: []string{"127.0.0.0/8"}, Format: "ascii"}, writer)
+
+	first := dialListener(t, listener)
+	if _, err := first.Write([]byte("n=01000123&v=120.5&p_1=100\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitForDevice(t, listener, "01000123", first)
+	if point, ok := writer.find("energy"); !ok || point.tags["serial"] != "01000123" {
+		t.Errorf("energy point = %+v, want one for 01000123", point)
+	}
+
+	// the device reconnecting replaces its previous connection
+	second := dialListener(t, listener)
+	if _, err := second.Write([]byte("n=01000123&v=120.5&p_1=100\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitForDevice(t, listener, "01000123", second)
+	if !closed(first) {
+		t.Error("previous connection for 01000123 is still open")
+	}
+	if listener.device("01000123") == nil {
+		t.Error("closing the previous connection forgot the device")
+	}
+
+	// another device is kept alongside it
+	other := dialListener(t, listener)
+	if _, err := other.Write([]byte("n=01000456&v=120.5&p_1=100\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitForDevice(t, listener, "01000456", other)
+	waitForDevice(t, listener, "01000123", second)
+}
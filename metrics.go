@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	"github.com/adamjacobmuller/brul2influx/influxbg"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultSelfMetricsInterval = time.Minute
+
+// SelfMetricsConfig writes brul2influx's own metrics to InfluxDB as the
+// brul2influx measurement.
+type SelfMetricsConfig struct {
+	// Interval is how often they are written, defaultSelfMetricsInterval
+	// if zero.
+	Interval Duration `json:"interval"`
+}
+
+func (s *SelfMetricsConfig) interval() time.Duration {
+	if s.Interval <= 0 {
+		return defaultSelfMetricsInterval
+	}
+	return time.Duration(s.Interval)
+}
+
+// sourceMetrics counts what has been received from one host.
+type sourceMetrics struct {
+	packets    atomic.Uint64
+	reconnects atomic.Uint64
+	// lastPacket is when the last packet was decoded, in Unix nanoseconds
+	lastPacket atomic.Int64
+
+	mu          sync.Mutex
+	parseErrors map[string]uint64
+}
+
+func (s *sourceMetrics) packet(received time.Time) {
+	s.packets.Add(1)
+	s.lastPacket.Store(received.UnixNano())
+}
+
+func (s *sourceMetrics) reconnect() {
+	s.reconnects.Add(1)
+}
+
+// parseErrorKinds names the decoding errors counted separately.
+var parseErrorKinds = []struct {
+	err  error
+	kind string
+}{
+	{gem.ErrEmptyPacket, "empty_packet"},
+	{gem.ErrMalformedPair, "malformed_pair"},
+	{gem.ErrMalformedKey, "malformed_key"},
+	{gem.ErrInvalidChannel, "invalid_channel"},
+	{gem.ErrInvalidValue, "invalid_value"},
+	{gem.ErrShortPacket, "short_packet"},
+	{gem.ErrBadHeader, "bad_header"},
+	{gem.ErrBadFooter, "bad_footer"},
+	{gem.ErrBadChecksum, "bad_checksum"},
+}
+
+func parseErrorKind(err error) string {
+	for _, kind := range parseErrorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.kind
+		}
+	}
+	return "other"
+}
+
+func (s *sourceMetrics) parseError(err error) {
+	kind := parseErrorKind(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parseErrors[kind]++
+}
+
+// sourceSnapshot is a copy of a host's counters.
+type sourceSnapshot struct {
+	host        string
+	packets     uint64
+	reconnects  uint64
+	lastPacket  time.Time
+	parseErrors map[string]uint64
+}
+
+// sourceRegistry holds the metrics of every host packets have been
+// received from, keyed by host name.
+type sourceRegistry struct {
+	mu      sync.Mutex
+	sources map[string]*sourceMetrics
+}
+
+func newSourceRegistry() *sourceRegistry {
+	return &sourceRegistry{
+		sources: make(map[string]*sourceMetrics),
+	}
+}
+
+// sources is shared by every packet source.
+var sources = newSourceRegistry()
+
+func (r *sourceRegistry) get(host string) *sourceMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	source, ok := r.sources[host]
+	if !ok {
+		source = &sourceMetrics{parseErrors: make(map[string]uint64)}
+		r.sources[host] = source
+	}
+	return source
+}
+
+// remoteSource returns the metrics for a connecting device, identified by
+// its address without the ephemeral port.
+func (r *sourceRegistry) remoteSource(remote string) *sourceMetrics {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return r.get(remote)
+}
+
+func (r *sourceRegistry) snapshot() []sourceSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshots := make([]sourceSnapshot, 0, len(r.sources))
+	for host, source := range r.sources {
+		snapshot := sourceSnapshot{
+			host:        host,
+			packets:     source.packets.Load(),
+			reconnects:  source.reconnects.Load(),
+			parseErrors: make(map[string]uint64),
+		}
+		if last := source.lastPacket.Load(); last != 0 {
+			snapshot.lastPacket = time.Unix(0, last)
+		}
+		source.mu.Lock()
+		for kind, n := range source.parseErrors {
+			snapshot.parseErrors[kind] = n
+		}
+		source.mu.Unlock()
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].host < snapshots[j].host
+	})
+	return snapshots
+}
+
+// selfMetrics reports on brul2influx itself: what each host sent and, when
+// InfluxDB is enabled, how the writer is keeping up.
+type selfMetrics struct {
+	sources *sourceRegistry
+	writer  *influxbg.InfluxBGWriter
+}
+
+// promFamily writes the HELP and TYPE lines of a metric.
+func promFamily(out io.Writer, name, help, kind string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func promSample(out io.Writer, name string, labels map[string]string, value float64) {
+	fmt.Fprintf(out, "%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *selfMetrics) writePrometheus(out io.Writer, now time.Time) {
+	snapshots := m.sources.snapshot()
+	if len(snapshots) > 0 {
+		promFamily(out, "brul2influx_packets_total", "Packets decoded from the host.", "counter")
+		for _, s := range snapshots {
+			promSample(out, "brul2influx_packets_total", map[string]string{"host": s.host}, float64(s.packets))
+		}
+		promFamily(out, "brul2influx_parse_errors_total", "Errors decoding packets from the host.", "counter")
+		for _, s := range snapshots {
+			kinds := make([]string, 0, len(s.parseErrors))
+			for kind := range s.parseErrors {
+				kinds = append(kinds, kind)
+			}
+			sort.Strings(kinds)
+			for _, kind := range kinds {
+				promSample(out, "brul2influx_parse_errors_total", map[string]string{"host": s.host, "error": kind}, float64(s.parseErrors[kind]))
+			}
+		}
+		promFamily(out, "brul2influx_reconnects_total", "Connections to the host that were lost and retried.", "counter")
+		for _, s := range snapshots {
+			promSample(out, "brul2influx_reconnects_total", map[string]string{"host": s.host}, float64(s.reconnects))
+		}
+		promFamily(out, "brul2influx_seconds_since_last_packet", "Time since a packet was last decoded from the host.", "gauge")
+		for _, s := range snapshots {
+			if !s.lastPacket.IsZero() {
+				promSample(out, "brul2influx_seconds_since_last_packet", map[string]string{"host": s.host}, now.Sub(s.lastPacket).Seconds())
+			}
+		}
+	}
+
+	if m.writer == nil {
+		return
+	}
+	stats := m.writer.Stats()
+	metrics := []struct {
+		name  string
+		help  string
+		kind  string
+		value float64
+	}{
+		{"brul2influx_influxdb_queue_depth", "Points waiting to be picked up by the writer.", "gauge", float64(stats.QueueDepth)},
+		{"brul2influx_influxdb_pending_points", "Points held in memory because they could not be written yet.", "gauge", float64(stats.Pending)},
+		{"brul2influx_influxdb_spool_bytes", "Size of the on-disk spool.", "gauge", float64(stats.SpoolBytes)},
+		{"brul2influx_influxdb_batch_limit_bytes", "Current limit on the size of a write request.", "gauge", float64(stats.BatchBytes)},
+		{"brul2influx_influxdb_last_batch_points", "Points in the last successful write request.", "gauge", float64(stats.LastBatchPoints)},
+		{"brul2influx_influxdb_last_batch_bytes", "Size of the last successful write request.", "gauge", float64(stats.LastBatchBytes)},
+		{"brul2influx_influxdb_points_written_total", "Points InfluxDB accepted.", "counter", float64(stats.Written)},
+		{"brul2influx_influxdb_points_dropped_total", "Points given up on without InfluxDB refusing them.", "counter", float64(stats.Dropped)},
+		{"brul2influx_influxdb_points_rejected_total", "Points InfluxDB refused.", "counter", float64(stats.Rejected)},
+		{"brul2influx_influxdb_retries_total", "Write requests resent in smaller pieces.", "counter", float64(stats.Retries)},
+		{"brul2influx_influxdb_too_large_total", "Write requests refused as too large.", "counter", float64(stats.TooLarge)},
+		{"brul2influx_influxdb_server_errors_total", "Write requests that failed with a server error.", "counter", float64(stats.ServerErrors)},
+	}
+	for _, metric := range metrics {
+		promFamily(out, metric.name, metric.help, metric.kind)
+		promSample(out, metric.name, nil, metric.value)
+	}
+	promFamily(out, "brul2influx_influxdb_write_duration_seconds", "Time spent on write requests.", "summary")
+	promSample(out, "brul2influx_influxdb_write_duration_seconds_sum", nil, stats.WriteTime.Seconds())
+	promSample(out, "brul2influx_influxdb_write_duration_seconds_count", nil, float64(stats.Requests))
+}
+
+// writePoints writes the metrics as brul2influx points, one per host and
+// one for the writer.
+func (m *selfMetrics) writePoints(w PointWriter, now time.Time) {
+	write := func(tags map[string]string, fields map[string]interface{}) {
+		err := w.Write("brul2influx", tags, fields, now)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"tags":   tags,
+				"fields": fields,
+			}).Error("unable to write point for brul2influx")
+		}
+	}
+
+	for _, s := range m.sources.snapshot() {
+		var parseErrors uint64
+		for _, n := range s.parseErrors {
+			parseErrors += n
+		}
+		fields := map[string]interface{}{
+			"packets":      int64(s.packets),
+			"parse-errors": int64(parseErrors),
+			"reconnects":   int64(s.reconnects),
+		}
+		if !s.lastPacket.IsZero() {
+			fields["seconds-since-last-packet"] = now.Sub(s.lastPacket).Seconds()
+		}
+		write(map[string]string{"component": "host", "host": s.host}, fields)
+	}
+
+	if m.writer == nil {
+		return
+	}
+	stats := m.writer.Stats()
+	write(map[string]string{"component": "influxdb"}, map[string]interface{}{
+		"queue-depth":         int64(stats.QueueDepth),
+		"pending-points":      int64(stats.Pending),
+		"spool-bytes":         stats.SpoolBytes,
+		"batch-limit-bytes":   int64(stats.BatchBytes),
+		"last-batch-points":   int64(stats.LastBatchPoints),
+		"last-batch-bytes":    int64(stats.LastBatchBytes),
+		"points-written":      int64(stats.Written),
+		"points-dropped":      int64(stats.Dropped),
+		"points-rejected":     int64(stats.Rejected),
+		"retries":             int64(stats.Retries),
+		"too-large":           int64(stats.TooLarge),
+		"server-errors":       int64(stats.ServerErrors),
+		"requests":            int64(stats.Requests),
+		"write-seconds-total": stats.WriteTime.Seconds(),
+	})
+}
+
+// run writes the metrics to w every interval until ctx is cancelled.
+func (m *selfMetrics) run(ctx context.Context, w PointWriter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.writePoints(w, now)
+		}
+	}
+}
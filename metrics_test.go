@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	registry := newSourceRegistry()
+	source := registry.get("gem:8000")
+	source.reconnect()
+
+	stream := "n=01000123&v=120.5&p_1=100\nn=01000123&v=bad&p_x=1\n"
+	packets := 0
+	readPackets(&HostConfig{Address: "gem:8000", Format: "ascii"}, bufio.NewReader(strings.NewReader(stream)), source, func(packet *gem.Packet) {
+		packets++
+	})
+	if packets != 2 {
+		t.Fatalf("decoded %d packets, want 2", packets)
+	}
+
+	metrics := &selfMetrics{sources: registry}
+	now := time.Unix(0, source.lastPacket.Load()).Add(30 * time.Second)
+	out := &bytes.Buffer{}
+	metrics.writePrometheus(out, now)
+
+	for _, want := range []string{
+		`brul2influx_packets_total{host="gem:8000"} 2`,
+		`brul2influx_parse_errors_total{error="invalid_channel",host="gem:8000"} 1`,
+		`brul2influx_parse_errors_total{error="invalid_value",host="gem:8000"} 1`,
+		`brul2influx_reconnects_total{host="gem:8000"} 1`,
+		`brul2influx_seconds_since_last_packet{host="gem:8000"} 30`,
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("missing %s in\n%s", want, out)
+		}
+	}
+
+	writer := &recordingWriter{}
+	metrics.writePoints(writer, now)
+	point, ok := writer.find("brul2influx")
+	if !ok {
+		t.Fatal("no brul2influx point written")
+	}
+	if point.tags["host"] != "gem:8000" || point.fields["packets"] != int64(2) || point.fields["parse-errors"] != int64(2) {
+		t.Errorf("point = %+v", point)
+	}
+}
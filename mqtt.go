@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// MQTTConfig configures publishing the latest readings to an MQTT broker,
+// with optional Home Assistant discovery.
+type MQTTConfig struct {
+	// Address is the broker's host:port. The port defaults to 1883, or
+	// 8883 when TLS is set.
+	Address string `json:"address"`
+	// ClientID defaults to "brul2influx-" followed by the hostname, so
+	// that replicas do not disconnect each other.
+	ClientID string     `json:"client_id"`
+	Username string     `json:"username"`
+	Password Secret     `json:"password"`
+	TLS      *TLSConfig `json:"tls"`
+	// TopicPrefix is prepended to every state topic, "brul2influx" by
+	// default.
+	TopicPrefix string `json:"topic_prefix"`
+	// QoS is 0 (the default) or 1.
+	QoS    int  `json:"qos"`
+	Retain bool `json:"retain"`
+	// Discovery publishes Home Assistant MQTT discovery configs under
+	// DiscoveryPrefix, "homeassistant" by default.
+	Discovery       bool   `json:"discovery"`
+	DiscoveryPrefix string `json:"discovery_prefix"`
+}
+
+func (m *MQTTConfig) Validate() error {
+	if m.Address == "" {
+		return fmt.Errorf("missing address")
+	}
+	if m.QoS != 0 && m.QoS != 1 {
+		return fmt.Errorf("qos must be 0 or 1")
+	}
+	if strings.ContainsAny(m.TopicPrefix, "+#") || strings.ContainsAny(m.DiscoveryPrefix, "+#") {
+		return fmt.Errorf("topic prefixes can not contain wildcards")
+	}
+	if m.TLS != nil && (m.TLS.CertFile == "") != (m.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+func (m *MQTTConfig) address() string {
+	if _, _, err := net.SplitHostPort(m.Address); err == nil {
+		return m.Address
+	}
+	if m.TLS != nil {
+		return net.JoinHostPort(m.Address, "8883")
+	}
+	return net.JoinHostPort(m.Address, "1883")
+}
+
+// brokerURL is the broker's address as paho expects it.
+func (m *MQTTConfig) brokerURL() string {
+	if m.TLS != nil {
+		return "ssl://" + m.address()
+	}
+	return "tcp://" + m.address()
+}
+
+func (m *MQTTConfig) clientID() string {
+	if m.ClientID != "" {
+		return m.ClientID
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "brul2influx"
+	}
+	return "brul2influx-" + hostname
+}
+
+func (m *MQTTConfig) topicPrefix() string {
+	if m.TopicPrefix == "" {
+		return "brul2influx"
+	}
+	return strings.TrimSuffix(m.TopicPrefix, "/")
+}
+
+func (m *MQTTConfig) discoveryPrefix() string {
+	if m.DiscoveryPrefix == "" {
+		return "homeassistant"
+	}
+	return strings.TrimSuffix(m.DiscoveryPrefix, "/")
+}
+
+func (m *MQTTConfig) statusTopic() string {
+	return m.topicPrefix() + "/status"
+}
+
+// mqttSensor describes how one field of a measurement is published and
+// announced to Home Assistant.
+type mqttSensor struct {
+	field       string
+	topic       string
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+	label       string
+	// scale converts the field to unit.
+	scale float64
+}
+
+// mqttSensors lists the sensors published for each measurement written by
+// writePacket. Topics are relative to the device's topic and %s is
+// replaced by the channel. In names %s is replaced by the channel's
+// configured name, or by label and the channel.
+var mqttSensors = map[string][]mqttSensor{
+	"voltage": {
+		{field: "volts", topic: "volts", name: "Voltage", unit: "V", deviceClass: "voltage", stateClass: "measurement"},
+	},
+	"energy": {
+		{field: "watts", topic: "channel/%s/watts", name: "%s power", label: "Channel", unit: "W", deviceClass: "power", stateClass: "measurement"},
+		{field: "watt-hours", topic: "channel/%s/energy", name: "%s energy", label: "Channel", unit: "kWh", deviceClass: "energy", stateClass: "total_increasing", scale: 0.001},
+		{field: "amps", topic: "channel/%s/amps", name: "%s current", label: "Channel", unit: "A", deviceClass: "current", stateClass: "measurement"},
+	},
+	"temperature": {
+		{field: "temperature", topic: "temperature/%s", name: "%s", label: "Temperature", unit: "°C", deviceClass: "temperature", stateClass: "measurement"},
+	},
+}
+
+// haDiscovery is a Home Assistant MQTT discovery config for a sensor.
+type haDiscovery struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// mqttState is the latest reading for a topic, along with the discovery
+// config announcing it when discovery is enabled.
+type mqttState struct {
+	payload         string
+	discoveryTopic  string
+	discoveryConfig []byte
+}
+
+// MQTTPublisher is a PointWriter that publishes the latest reading of each
+// sensor. Readings are coalesced per topic, so only the most recent value
+// is sent if the broker is slow or unreachable.
+type MQTTPublisher struct {
+	config *MQTTConfig
+
+	mu      sync.Mutex
+	pending map[string]*mqttState
+	wake    chan struct{}
+}
+
+func NewMQTTPublisher(config *MQTTConfig) *MQTTPublisher {
+	return &MQTTPublisher{
+		config:  config,
+		pending: make(map[string]*mqttState),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Write queues the readings in a point; anything that does not map to a
+// sensor is ignored.
+func (p *MQTTPublisher) Write(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) error {
+	sensors, ok := mqttSensors[measurement]
+	if !ok {
+		return nil
+	}
+	serial := tags["serial"]
+	if serial == "" {
+		return nil
+	}
+	channel := tags["channel"]
+
+	p.mu.Lock()
+	for i := range sensors {
+		sensor := &sensors[i]
+		value, ok := promValue(fields[sensor.field])
+		if !ok {
+			continue
+		}
+		if sensor.scale != 0 {
+			value *= sensor.scale
+		}
+
+		relative := sensor.topic
+		if strings.Contains(relative, "%s") {
+			relative = fmt.Sprintf(relative, channel)
+		}
+		topic := p.config.topicPrefix() + "/" + serial + "/" + relative
+
+		state := &mqttState{payload: strconv.FormatFloat(value, 'f', -1, 64)}
+		if p.config.Discovery {
+			state.discoveryTopic, state.discoveryConfig = p.discovery(sensor, tags, topic)
+		}
+		p.pending[topic] = state
+	}
+	p.mu.Unlock()
+
+	p.notify()
+	return nil
+}
+
+func (p *MQTTPublisher) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// discovery returns the Home Assistant discovery topic and config for a
+// sensor.
+func (p *MQTTPublisher) discovery(sensor *mqttSensor, tags map[string]string, stateTopic string) (string, []byte) {
+	serial := tags["serial"]
+	objectID := strings.ReplaceAll(strings.TrimPrefix(stateTopic, p.config.topicPrefix()+"/"+serial+"/"), "/", "_")
+	name := sensor.name
+	if strings.Contains(name, "%s") {
+		channelName := tags["name"]
+		if channelName == "" {
+			channelName = sensor.label + " " + tags["channel"]
+		}
+		name = fmt.Sprintf(name, channelName)
+	}
+	model := tags["device_model"]
+	if model == "" {
+		model = "GEM"
+	}
+
+	config, _ := json.Marshal(haDiscovery{
+		Name:              name,
+		UniqueID:          "brul2influx_" + serial + "_" + objectID,
+		StateTopic:        stateTopic,
+		AvailabilityTopic: p.config.statusTopic(),
+		UnitOfMeasurement: sensor.unit,
+		DeviceClass:       sensor.deviceClass,
+		StateClass:        sensor.stateClass,
+		Device: haDevice{
+			Identifiers:  []string{"brultech_" + serial},
+			Name:         "Brultech " + model + " " + serial,
+			Manufacturer: "Brultech",
+			Model:        model,
+		},
+	})
+	topic := p.config.discoveryPrefix() + "/sensor/brul2influx_" + serial + "/" + objectID + "/config"
+	return topic, config
+}
+
+// take returns the pending readings, leaving none.
+func (p *MQTTPublisher) take() map[string]*mqttState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending := p.pending
+	p.pending = make(map[string]*mqttState)
+	return pending
+}
+
+// requeue puts back readings that could not be published, unless a newer
+// one has arrived in the meantime.
+func (p *MQTTPublisher) requeue(states map[string]*mqttState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for topic, state := range states {
+		if _, ok := p.pending[topic]; !ok {
+			p.pending[topic] = state
+		}
+	}
+}
+
+// mqttTimeout bounds connecting and waiting for the broker to acknowledge
+// a publish.
+const mqttTimeout = 10 * time.Second
+
+// Run connects to the broker and publishes readings until ctx is
+// cancelled, reconnecting with backoff whenever the connection fails.
+func (p *MQTTPublisher) Run(ctx context.Context) error {
+	options := mqtt.NewClientOptions().
+		AddBroker(p.config.brokerURL()).
+		SetClientID(p.config.clientID()).
+		SetUsername(p.config.Username).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectTimeout(mqttTimeout).
+		SetWriteTimeout(mqttTimeout).
+		SetWill(p.config.statusTopic(), "offline", byte(p.config.QoS), true)
+	password, err := p.config.Password.Resolve()
+	if err != nil {
+		return fmt.Errorf("password: %w", err)
+	}
+	options.SetPassword(password)
+	if p.config.TLS != nil {
+		tlsConfig, err := p.config.TLS.config()
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		options.SetTLSConfig(tlsConfig)
+	}
+
+	attempt := 0
+	for {
+		started := time.Now()
+		err := p.session(ctx, options)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if time.Since(started) >= backoffResetAfter {
+			attempt = 0
+		}
+		delay := backoff(attempt)
+		attempt++
+
+		log.WithFields(log.Fields{
+			"error":   err,
+			"address": p.config.Address,
+			"backoff": delay,
+		}).Error("connection to mqtt broker lost, reconnecting")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// wait waits for token to complete, giving up after mqttTimeout.
+func wait(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timed out after %s", mqttTimeout)
+	}
+	return token.Error()
+}
+
+// session publishes readings over a single connection until it fails or
+// ctx is cancelled. Discovery configs are published once per connection,
+// before the first reading for each sensor.
+func (p *MQTTPublisher) session(ctx context.Context, options *mqtt.ClientOptions) error {
+	lost := make(chan error, 1)
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		lost <- err
+	})
+	client := mqtt.NewClient(options)
+	err := wait(client.Connect())
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(uint(time.Second / time.Millisecond))
+
+	log.WithFields(log.Fields{
+		"address": p.config.Address,
+	}).Info("connected to mqtt broker")
+
+	qos := byte(p.config.QoS)
+	publish := func(topic string, payload []byte, retain bool) error {
+		return wait(client.Publish(topic, qos, retain, payload))
+	}
+	err = publish(p.config.statusTopic(), []byte("online"), true)
+	if err != nil {
+		return err
+	}
+
+	// publish anything left over from the previous connection
+	p.notify()
+
+	announced := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			// disconnecting cleanly discards the will, so mark the
+			// publisher offline before closing
+			return publish(p.config.statusTopic(), []byte("offline"), true)
+		case err := <-lost:
+			return err
+		case <-p.wake:
+		}
+
+		pending := p.take()
+		for topic, state := range pending {
+			if state.discoveryTopic != "" && !announced[state.discoveryTopic] {
+				err = publish(state.discoveryTopic, state.discoveryConfig, true)
+				if err != nil {
+					p.requeue(pending)
+					return err
+				}
+				announced[state.discoveryTopic] = true
+			}
+
+			err = publish(topic, []byte(state.payload), p.config.Retain)
+			if err != nil {
+				p.requeue(pending)
+				return err
+			}
+			delete(pending, topic)
+		}
+	}
+}
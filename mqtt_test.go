@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/rs/zerolog"
+)
+
+// testBroker is an embedded broker that accepts every connection.
+type testBroker struct {
+	server *mochi.Server
+	addr   string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	server := mochi.New(&mochi.Options{Logger: &logger})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewNet("test", ln)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return &testBroker{server: server, addr: ln.Addr().String()}
+}
+
+// retained returns the message retained on topic.
+func (b *testBroker) retained(topic string) ([]byte, bool) {
+	messages := b.server.Topics.Messages(topic)
+	if len(messages) == 0 {
+		return nil, false
+	}
+	return messages[0].Payload, true
+}
+
+// disconnect drops every client's connection without a DISCONNECT, so
+// that their wills are published.
+func (b *testBroker) disconnect() {
+	for _, client := range b.server.Clients.GetAll() {
+		client.Stop(errors.New("dropped by test"))
+	}
+}
+
+func waitRetained(t *testing.T, broker *testBroker, topic string) []byte {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if payload, ok := broker.retained(topic); ok {
+			return payload
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing retained on %s", topic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitPayload(t *testing.T, broker *testBroker, topic, payload string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if got, _ := broker.retained(topic); string(got) == payload {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never became %q", topic, payload)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker := newTestBroker(t)
+	config := &MQTTConfig{Address: broker.addr, Retain: true, QoS: 1, Discovery: true}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	publisher := NewMQTTPublisher(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		publisher.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	packet, err := gem.ParseASCII([]byte("n=01000123&v=120.5&wh_2=1500&p_2=250&a_2=2.1&t_1=21.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePacket(publisher, &HostConfig{Address: "gem:8000"}, packet, time.Now())
+
+	states := map[string]string{
+		"brul2influx/status":                    "online",
+		"brul2influx/01000123/volts":            "120.5",
+		"brul2influx/01000123/channel/2/watts":  "250",
+		"brul2influx/01000123/channel/2/energy": "1.5",
+		"brul2influx/01000123/channel/2/amps":   "2.1",
+		"brul2influx/01000123/temperature/1":    "21.5",
+	}
+	for topic, want := range states {
+		if got := string(waitRetained(t, broker, topic)); got != want {
+			t.Errorf("%s = %q, want %q", topic, got, want)
+		}
+	}
+
+	payload := waitRetained(t, broker, "homeassistant/sensor/brul2influx_01000123/channel_2_energy/config")
+	var discovery haDiscovery
+	if err := json.Unmarshal(payload, &discovery); err != nil {
+		t.Fatal(err)
+	}
+	want := haDiscovery{
+		Name:              "Channel 2 energy",
+		UniqueID:          "brul2influx_01000123_channel_2_energy",
+		StateTopic:        "brul2influx/01000123/channel/2/energy",
+		AvailabilityTopic: "brul2influx/status",
+		UnitOfMeasurement: "kWh",
+		DeviceClass:       "energy",
+		StateClass:        "total_increasing",
+		Device: haDevice{
+			Identifiers:  []string{"brultech_01000123"},
+			Name:         "Brultech GEM 01000123",
+			Manufacturer: "Brultech",
+			Model:        "GEM",
+		},
+	}
+	got, _ := json.Marshal(discovery)
+	expected, _ := json.Marshal(want)
+	if string(got) != string(expected) {
+		t.Errorf("discovery = %s, want %s", got, expected)
+	}
+
+	// a lost connection publishes the will, and reconnecting marks the
+	// publisher online again
+	broker.disconnect()
+	waitPayload(t, broker, "brul2influx/status", "offline")
+	waitPayload(t, broker, "brul2influx/status", "online")
+
+	// shutting down cleanly marks the publisher offline too
+	cancel()
+	<-done
+	if payload, _ := broker.retained("brul2influx/status"); string(payload) != "offline" {
+		t.Errorf("brul2influx/status = %q after shutting down, want offline", payload)
+	}
+}
+
+func TestMQTTClientID(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := (&MQTTConfig{}).clientID(); got != "brul2influx-"+hostname {
+		t.Errorf("default client ID = %q, want one per host", got)
+	}
+	if got := (&MQTTConfig{ClientID: "house"}).clientID(); got != "house" {
+		t.Errorf("client ID = %q, want house", got)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultConfigPath = "/config/config.json"
+
+// options are the command line flags. Each defaults to an environment
+// variable, and the listen addresses override those in the configuration
+// file, enabling the server if it is not configured there.
+type options struct {
+	config     string
+	logLevel   log.Level
+	listen     string
+	http       string
+	prometheus string
+	health     string
+}
+
+func parseOptions(args []string, getenv func(string) string, output io.Writer) (*options, error) {
+	o := &options{}
+	flags := flag.NewFlagSet("brul2influx", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprintf(output, "usage: brul2influx [flags]\n       brul2influx validate <file>...\n\nflags:\n")
+		flags.PrintDefaults()
+	}
+
+	env := func(name, value string) string {
+		if v := getenv(name); v != "" {
+			return v
+		}
+		return value
+	}
+	flags.StringVar(&o.config, "config", env("BRUL2INFLUX_CONFIG", defaultConfigPath), "configuration `file`, JSON or YAML ($BRUL2INFLUX_CONFIG)")
+	var logLevel string
+	flags.StringVar(&logLevel, "log-level", env("BRUL2INFLUX_LOG_LEVEL", "info"), "log `level`: debug, info, warn or error ($BRUL2INFLUX_LOG_LEVEL)")
+	flags.StringVar(&o.listen, "listen", env("BRUL2INFLUX_LISTEN", ""), "`address` to accept device connections on ($BRUL2INFLUX_LISTEN)")
+	flags.StringVar(&o.http, "http", env("BRUL2INFLUX_HTTP", ""), "`address` to accept HTTP posts on ($BRUL2INFLUX_HTTP)")
+	flags.StringVar(&o.prometheus, "prometheus", env("BRUL2INFLUX_PROMETHEUS", ""), "`address` to serve Prometheus metrics on ($BRUL2INFLUX_PROMETHEUS)")
+	flags.StringVar(&o.health, "health", env("BRUL2INFLUX_HEALTH", ""), "`address` to serve health checks on ($BRUL2INFLUX_HEALTH)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	o.logLevel, err = log.ParseLevel(logLevel)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// apply overrides the listen addresses in config.
+func (o *options) apply(config *Config) {
+	if o.listen != "" {
+		if config.Listen == nil {
+			config.Listen = &ListenConfig{}
+		}
+		config.Listen.Address = o.listen
+	}
+	if o.http != "" {
+		if config.HTTP == nil {
+			config.HTTP = &HTTPIngestConfig{}
+		}
+		config.HTTP.Address = o.http
+	}
+	if o.prometheus != "" {
+		if config.Prometheus == nil {
+			config.Prometheus = &PrometheusConfig{}
+		}
+		config.Prometheus.Address = o.prometheus
+	}
+	if o.health != "" {
+		if config.Health == nil {
+			config.Health = &HealthConfig{}
+		}
+		config.Health.Address = o.health
+	}
+}
+
+// validateCommand checks the configuration files in args without starting
+// anything, printing every error found, and returns the exit status.
+func validateCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, "usage: brul2influx validate <file>...\n")
+		return 2
+	}
+	status := 0
+	for _, path := range args {
+		_, err := loadValidConfig(path)
+		if err != nil {
+			for _, line := range strings.Split(err.Error(), "\n") {
+				fmt.Fprintf(stderr, "%s\n", filePosition(path, line))
+			}
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: ok\n", path)
+	}
+	return status
+}
+
+// errorPosition matches the position errors loading a configuration start
+// with, from parseConfig, Validate or the YAML parser.
+var errorPosition = regexp.MustCompile(`^(yaml: )?line (\d+)(, column (\d+))?: `)
+
+// filePosition formats an error from loading the configuration file at
+// path as file:line: message, the way compilers do, so that editors can
+// jump to it.
+func filePosition(path, message string) string {
+	match := errorPosition.FindStringSubmatch(message)
+	if match == nil {
+		return path + ": " + message
+	}
+	position := path + ":" + match[2]
+	if match[4] != "" {
+		position += ":" + match[4]
+	}
+	return position + ": " + match[1] + message[len(match[0]):]
+}
+
+// loadValidConfig loads the configuration file at path and validates it.
+func loadValidConfig(path string) (*Config, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
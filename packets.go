@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	log "github.com/sirupsen/logrus"
+)
+
+// PointWriter is implemented by influxbg.InfluxBGWriter and
+// PrometheusExporter.
+type PointWriter interface {
+	Write(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) error
+}
+
+// multiWriter writes each point to every one of its writers.
+type multiWriter []PointWriter
+
+func (m multiWriter) Write(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) error {
+	var errs []error
+	for _, w := range m {
+		err := w.Write(measurement, tags, fields, ts)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readPackets decodes packets from reader until it fails, passing each one
+// to handle and counting them in source. It returns the error that ended
+// the stream.
+func readPackets(hostConfig *HostConfig, reader *bufio.Reader, source *sourceMetrics, handle func(packet *gem.Packet)) error {
+	gemHost := hostConfig.Name()
+
+	format, err := hostFormat(hostConfig, reader)
+	if err != nil {
+		return fmt.Errorf("unable to detect packet format: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"format":  format,
+		"gemHost": gemHost,
+	}).Info("reading packets")
+
+	scanner := bufio.NewScanner(reader)
+	decode := func(data []byte) (*gem.Packet, error) {
+		return gem.ParseASCII(data)
+	}
+	if model := hostConfig.Model(); model != "" {
+		scanner.Split(gem.SplitECM)
+		decode = gem.NewECMDecoder(model).Decode
+	} else if format.Binary() {
+		scanner.Split(gem.SplitBinary)
+		decode = gem.NewBinaryDecoder().Decode
+	}
+
+	for scanner.Scan() {
+		packet, err := decode(scanner.Bytes())
+		if packet == nil {
+			source.parseError(err)
+			log.WithFields(log.Fields{
+				"error":   err,
+				"data":    fmt.Sprintf("%q", scanner.Bytes()),
+				"gemHost": gemHost,
+			}).Error("unable to decode packet")
+			continue
+		}
+		var parseErr *gem.ParseError
+		if errors.As(err, &parseErr) {
+			for _, fieldErr := range parseErr.Fields {
+				source.parseError(fieldErr)
+				log.WithFields(log.Fields{
+					"error":     fieldErr.Cause,
+					"dataPoint": fieldErr.Pair,
+					"dataTrim":  scanner.Text(),
+					"gemHost":   gemHost,
+				}).Error(fieldErr.Err.Error())
+			}
+		}
+
+		source.packet(time.Now())
+		handle(packet)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// hostFormat returns the packet format configured for host, detecting it
+// from the first bytes available on reader when set to auto.
+func hostFormat(host *HostConfig, reader *bufio.Reader) (gem.Format, error) {
+	if host.Model() != "" {
+		return gem.FormatECMBinary, nil
+	}
+
+	switch host.Format {
+	case "ascii":
+		return gem.FormatASCII, nil
+	case "binary":
+		return gem.FormatGEM48PTBinary, nil
+	}
+
+	for {
+		_, err := reader.Peek(1)
+		if err != nil {
+			return gem.FormatUnknown, err
+		}
+		data, err := reader.Peek(reader.Buffered())
+		if err != nil {
+			return gem.FormatUnknown, err
+		}
+		format, ok := gem.Detect(data)
+		if ok {
+			return format, nil
+		}
+	}
+}
+
+// handlePacket writes packet, received at received, timestamped as the
+// host is configured to, followed by packet accounting when it is due.
+func handlePacket(ibgw PointWriter, host *HostConfig, packet *gem.Packet, received time.Time) {
+	ts, stats := clocks.observe(host.Name(), packet, received)
+	if host.Timestamps == "received" {
+		ts = received
+	}
+
+	writePacket(ibgw, host, packet, ts)
+
+	if stats != nil {
+		writePacketStats(ibgw, host, packet.Serial, stats, ts)
+	}
+}
+
+// writePacketStats writes a device's packet accounting. It is tagged by
+// serial only: the accounting follows the device across reconnects, and
+// for listener and HTTP ingest connections the host is the device's
+// address and ephemeral port.
+func writePacketStats(ibgw PointWriter, host *HostConfig, serial string, stats *deviceStats, ts time.Time) {
+	tags := map[string]string{
+		"serial": serial,
+	}
+	fields := map[string]interface{}{
+		"packets":    int64(stats.Packets),
+		"gaps":       int64(stats.Gaps),
+		"duplicates": int64(stats.Duplicates),
+		"reboots":    int64(stats.Reboots),
+	}
+
+	err := ibgw.Write("packet_stats", tags, fields, ts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"tags":    tags,
+			"fields":  fields,
+			"gemHost": host.Name(),
+		}).Error("unable to write point for packet stats")
+	}
+}
+
+func writePacket(ibgw PointWriter, host *HostConfig, packet *gem.Packet, ts time.Time) {
+	serial := packet.Serial
+	gemHost := host.Name()
+
+	log.WithFields(log.Fields{
+		"format": packet.Format,
+		"serial": serial,
+		"volts":  packet.Volts,
+	}).Info("decoded voltage data")
+
+	voltage_tags := map[string]string{
+		"serial": serial,
+	}
+	voltage_fields := map[string]interface{}{
+		"volts": packet.Volts,
+	}
+	if packet.Format == gem.FormatECMBinary {
+		voltage_fields["dc-volts"] = packet.DCVolts
+	}
+	if host.SecondsCounter && packet.HasSeconds {
+		voltage_fields["seconds"] = packet.Seconds
+	}
+	if packet.Model != "" {
+		voltage_tags["device_model"] = packet.Model
+	}
+
+	config := packetConfigs.get()
+	device := config.device(serial)
+
+	err := ibgw.Write("voltage", voltage_tags, voltage_fields, ts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"tags":    voltage_tags,
+			"fields":  voltage_fields,
+			"gemHost": gemHost,
+		}).Error("unable to write point for voltage")
+	}
+
+	for channel, value := range packet.Energy {
+		channelConfig := device.channel("energy", channel)
+		if channelConfig != nil && channelConfig.Disabled {
+			continue
+		}
+		energy_tags := map[string]string{
+			"serial":  serial,
+			"channel": fmt.Sprintf("%d", channel),
+		}
+		if channelConfig != nil {
+			channelConfig.addTags(energy_tags)
+			corrected := channelConfig.energy(*value)
+			value = &corrected
+		}
+		config.virtual.record(serial, channel, *value, ts)
+		energy_fields := map[string]interface{}{
+			"watt-hours": value.WattHours,
+			"watts":      value.Watts,
+			"amps":       value.Amps,
+		}
+		if packet.Model != "" {
+			energy_tags["device_model"] = packet.Model
+		}
+		if packet.Format.Binary() {
+			energy_fields["absolute-watt-seconds"] = int64(value.AbsoluteWattSeconds)
+			energy_fields["polarized-watt-seconds"] = int64(value.PolarizedWattSeconds)
+		}
+
+		err := ibgw.Write("energy", energy_tags, energy_fields, ts)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"tags":    energy_tags,
+				"fields":  energy_fields,
+				"gemHost": gemHost,
+			}).Error("unable to create point for energy")
+		}
+	}
+	config.virtual.evaluate(ibgw, serial, ts)
+
+	for channel, value := range packet.Temperature {
+		channelConfig := device.channel("temperature", channel)
+		if channelConfig != nil && channelConfig.Disabled {
+			continue
+		}
+		temperature_tags := map[string]string{
+			"serial":  serial,
+			"channel": fmt.Sprintf("%d", channel),
+		}
+		if channelConfig != nil {
+			channelConfig.addTags(temperature_tags)
+		}
+		temperature_fields := map[string]interface{}{
+			"temperature": value.Temperature,
+		}
+
+		err := ibgw.Write("temperature", temperature_tags, temperature_fields, ts)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"tags":    temperature_tags,
+				"fields":  temperature_fields,
+				"gemHost": gemHost,
+			}).Error("unable to create point for temperature")
+		}
+	}
+	for channel, value := range packet.Pulse {
+		channelConfig := device.channel("pulses", channel)
+		if channelConfig != nil && channelConfig.Disabled {
+			continue
+		}
+		pulse_tags := map[string]string{
+			"serial":  serial,
+			"channel": fmt.Sprintf("%d", channel),
+		}
+		if channelConfig != nil {
+			channelConfig.addTags(pulse_tags)
+		}
+		pulse_fields := map[string]interface{}{
+			"pulses": value.Pulses,
+		}
+
+		err := ibgw.Write("pulses", pulse_tags, pulse_fields, ts)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"tags":    pulse_tags,
+				"fields":  pulse_fields,
+				"gemHost": gemHost,
+			}).Error("unable to create point for pulses")
+		}
+	}
+}
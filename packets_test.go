@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+)
+
+type recordedPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]interface{}
+}
+
+type recordingWriter struct {
+	mu     sync.Mutex
+	points []recordedPoint
+}
+
+func (w *recordingWriter) Write(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.points = append(w.points, recordedPoint{measurement: measurement, tags: tags, fields: fields})
+	return nil
+}
+
+func (w *recordingWriter) find(measurement string) (recordedPoint, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, point := range w.points {
+		if point.measurement == measurement {
+			return point, true
+		}
+	}
+	return recordedPoint{}, false
+}
+
+func TestWritePacketSecondsCounter(t *testing.T) {
+	packet, err := gem.ParseASCII([]byte("n=01000123&m=4242&v=120.5&p_1=100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &recordingWriter{}
+	writePacket(writer, &HostConfig{Address: "gem:8000"}, packet, time.Now())
+	point, _ := writer.find("voltage")
+	if _, ok := point.fields["seconds"]; ok {
+		t.Errorf("seconds written without seconds_counter: %v", point.fields)
+	}
+
+	writer = &recordingWriter{}
+	writePacket(writer, &HostConfig{Address: "gem:8000", SecondsCounter: true}, packet, time.Now())
+	point, _ = writer.find("voltage")
+	if point.fields["seconds"] != int64(4242) {
+		t.Errorf("seconds = %v, want 4242", point.fields["seconds"])
+	}
+}
+
+func TestPacketStatsTags(t *testing.T) {
+	writer := &recordingWriter{}
+	received := time.Now()
+	// the device reconnects from another port and repeats a packet,
+	// which reports its accounting straight away
+	handlePacket(writer, &HostConfig{Address: "192.0.2.10:50123"}, secondsPacket("01000789", 100), received)
+	handlePacket(writer, &HostConfig{Address: "192.0.2.10:50124"}, secondsPacket("01000789", 100), received)
+
+	point, ok := writer.find("packet_stats")
+	if !ok {
+		t.Fatal("no packet_stats written")
+	}
+	if len(point.tags) != 1 || point.tags["serial"] != "01000789" {
+		t.Errorf("packet_stats tags = %v, want only the serial", point.tags)
+	}
+}
+
+func TestWritePacketChannelMetadata(t *testing.T) {
+	config := &Config{}
+	err := json.Unmarshal([]byte(`{
+		"influxdb": "http://influxdb:8086",
+		"devices": {
+			"01000123": {
+				"channels": {
+					"1": {"name": "Kitchen", "panel": "main", "breaker": "12", "room": "kitchen"},
+					"2": {"disabled": true},
+					"3": {"invert": true, "scale": 2}
+				},
+				"temperatures": {"1": {"name": "Attic"}}
+			}
+		}
+	}`), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	packetConfigs.set(config.Devices, nil)
+	defer packetConfigs.set(nil, nil)
+
+	packet, err := gem.ParseASCII([]byte("n=01000123&v=120.5&p_1=100&p_2=200&p_3=300&wh_3=10&a_3=1.5&p_4=400&t_1=20.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &recordingWriter{}
+	writePacket(writer, &HostConfig{Address: "gem:8000"}, packet, time.Now())
+
+	energy := map[string]recordedPoint{}
+	for _, point := range writer.points {
+		switch point.measurement {
+		case "energy":
+			energy[point.tags["channel"]] = point
+		case "temperature":
+			if point.tags["name"] != "Attic" {
+				t.Errorf("temperature tags = %v, want name Attic", point.tags)
+			}
+		}
+	}
+
+	tags := energy["1"].tags
+	if tags["name"] != "Kitchen" || tags["panel"] != "main" || tags["breaker"] != "12" || tags["room"] != "kitchen" {
+		t.Errorf("channel 1 tags = %v", tags)
+	}
+	if _, ok := energy["2"]; ok {
+		t.Error("disabled channel 2 was written")
+	}
+	if fields := energy["3"].fields; fields["watts"] != -600.0 || fields["watt-hours"] != 20.0 || fields["amps"] != 3.0 {
+		t.Errorf("channel 3 fields = %v, want inverted and doubled", fields)
+	}
+	if tags := energy["4"].tags; len(tags) != 2 || energy["4"].fields["watts"] != 400.0 {
+		t.Errorf("unconfigured channel 4 = %+v, want it unchanged", energy["4"])
+	}
+}
+
+// gem32Frame encodes a GEM32PTBinary frame from serial 01000123 with the
+// given watt-second counters.
+func gem32Frame(seconds uint32, absolute, polarized map[int]uint64) []byte {
+	putLE := func(b *bytes.Buffer, v uint64, n int) {
+		for i := 0; i < n; i++ {
+			b.WriteByte(byte(v >> (8 * i)))
+		}
+	}
+	b := &bytes.Buffer{}
+	b.Write([]byte{0xfe, 0xff, 0x05, 0x04, 0xb0})
+	for _, counters := range []map[int]uint64{absolute, polarized} {
+		for i := 1; i <= 32; i++ {
+			putLE(b, counters[i], 5)
+		}
+	}
+	b.Write([]byte{0x00, 123, 0x00, 10})
+	b.Write(make([]byte, 32*2))
+	putLE(b, uint64(seconds), 3)
+	b.Write(make([]byte, 4*3+8*2))
+	b.Write([]byte{0xff, 0xfe})
+	var sum byte
+	for _, c := range b.Bytes() {
+		sum += c
+	}
+	return append(b.Bytes(), sum)
+}
+
+func TestWritePacketInvertBinary(t *testing.T) {
+	packetConfigs.set(map[string]*DeviceConfig{
+		"01000123": {Channels: map[int64]*ChannelConfig{1: {Invert: true}, 2: {Invert: true}}},
+	}, nil)
+	defer packetConfigs.set(nil, nil)
+
+	decoder := gem.NewBinaryDecoder()
+	_, err := decoder.Decode(gem32Frame(100, map[int]uint64{1: 1000, 2: 1000, 3: 1000}, map[int]uint64{1: 400, 2: 400, 3: 400}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// channel 1 is installed backwards on a load drawing 500 W, so the
+	// device sees it exporting; channel 2 backwards on solar exporting
+	// 100 W; channel 3 the right way round on a load drawing 200 W
+	packet, err := decoder.Decode(gem32Frame(110,
+		map[int]uint64{1: 1000 + 10*500, 2: 1000 + 10*100, 3: 1000 + 10*200},
+		map[int]uint64{1: 400, 2: 400 + 10*100, 3: 400 + 10*200}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &recordingWriter{}
+	writePacket(writer, &HostConfig{Address: "gem:8000"}, packet, time.Now())
+
+	want := map[string]struct {
+		watts     float64
+		polarized int64
+	}{
+		"1": {watts: 500, polarized: 6000 - 400},
+		"2": {watts: -100, polarized: 2000 - 1400},
+		"3": {watts: 200, polarized: 2400},
+	}
+	checked := 0
+	for _, point := range writer.points {
+		if point.measurement != "energy" {
+			continue
+		}
+		want, ok := want[point.tags["channel"]]
+		if !ok {
+			continue
+		}
+		checked++
+		if point.fields["watts"] != want.watts || point.fields["polarized-watt-seconds"] != want.polarized {
+			t.Errorf("channel %s fields = %v, want %v W and %d polarized watt-seconds", point.tags["channel"], point.fields, want.watts, want.polarized)
+		}
+	}
+	if checked != len(want) {
+		t.Errorf("wrote %d of channels 1-3", checked)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultStaleAfter = 5 * time.Minute
+
+// PrometheusConfig configures the HTTP listener that exposes the latest
+// readings in the Prometheus text format.
+type PrometheusConfig struct {
+	Address string `json:"address"`
+	// Path is the URL path metrics are served on, "/metrics" by default.
+	Path string `json:"path"`
+	// StaleAfter is how long a series is exposed after its last update,
+	// so that devices that disappear drop out. It defaults to
+	// defaultStaleAfter.
+	StaleAfter Duration `json:"stale_after"`
+}
+
+func (p *PrometheusConfig) staleAfter() time.Duration {
+	if p.StaleAfter <= 0 {
+		return defaultStaleAfter
+	}
+	return time.Duration(p.StaleAfter)
+}
+
+// promMetric maps one field of a measurement to a metric.
+type promMetric struct {
+	name  string
+	help  string
+	kind  string
+	field string
+}
+
+// promMetrics lists the metrics exported for each measurement written by
+// writePacket.
+var promMetrics = map[string][]promMetric{
+	"voltage": {
+		{name: "gem_volts", help: "Line voltage measured by the device.", kind: "gauge", field: "volts"},
+		{name: "gem_dc_volts", help: "DC supply voltage measured by an ECM.", kind: "gauge", field: "dc-volts"},
+	},
+	"energy": {
+		{name: "gem_channel_watts", help: "Power on the channel.", kind: "gauge", field: "watts"},
+		{name: "gem_channel_watt_hours_total", help: "Energy used on the channel.", kind: "counter", field: "watt-hours"},
+		{name: "gem_channel_amps", help: "Current on the channel.", kind: "gauge", field: "amps"},
+	},
+	"temperature": {
+		{name: "gem_temperature_celsius", help: "Temperature sensor reading.", kind: "gauge", field: "temperature"},
+	},
+	"pulses": {
+		{name: "gem_pulses_total", help: "Pulses counted on the channel.", kind: "counter", field: "pulses"},
+	},
+}
+
+type promSeries struct {
+	metric  *promMetric
+	labels  string
+	value   float64
+	updated time.Time
+}
+
+// PrometheusExporter is a PointWriter that keeps the latest value of each
+// series and serves them to Prometheus. Point tags become labels, so
+// anything added to the tags written for a channel is exposed too.
+type PrometheusExporter struct {
+	staleAfter time.Duration
+	now        func() time.Time
+	// self, when set, adds brul2influx's own metrics
+	self *selfMetrics
+
+	mu     sync.Mutex
+	series map[string]*promSeries
+}
+
+func NewPrometheusExporter(config *PrometheusConfig, self *selfMetrics) *PrometheusExporter {
+	return &PrometheusExporter{
+		staleAfter: config.staleAfter(),
+		now:        time.Now,
+		self:       self,
+		series:     make(map[string]*promSeries),
+	}
+}
+
+// Write records the fields of a point that map to metrics; anything else
+// is ignored.
+func (e *PrometheusExporter) Write(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) error {
+	metrics, ok := promMetrics[measurement]
+	if !ok {
+		return nil
+	}
+	labels := formatLabels(tags)
+	now := e.now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range metrics {
+		metric := &metrics[i]
+		value, ok := promValue(fields[metric.field])
+		if !ok {
+			continue
+		}
+		key := metric.name + labels
+		series := e.series[key]
+		if series == nil {
+			series = &promSeries{metric: metric, labels: labels}
+			e.series[key] = series
+		}
+		series.value = value
+		series.updated = now
+	}
+	return nil
+}
+
+func promValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// formatLabels renders tags as a Prometheus label set with sorted names.
+func formatLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := &strings.Builder{}
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labelName(name))
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(tags[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelName replaces characters Prometheus does not allow in label names.
+func labelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// expireLocked drops series that have not been updated within staleAfter.
+func (e *PrometheusExporter) expireLocked(now time.Time) {
+	for key, series := range e.series {
+		if now.Sub(series.updated) > e.staleAfter {
+			delete(e.series, key)
+		}
+	}
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := e.now()
+	e.mu.Lock()
+	e.expireLocked(now)
+	series := make([]*promSeries, 0, len(e.series))
+	for _, s := range e.series {
+		series = append(series, s)
+	}
+	e.mu.Unlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].metric.name != series[j].metric.name {
+			return series[i].metric.name < series[j].metric.name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	var family string
+	for _, s := range series {
+		if s.metric.name != family {
+			family = s.metric.name
+			fmt.Fprintf(out, "# HELP %s %s\n", s.metric.name, s.metric.help)
+			fmt.Fprintf(out, "# TYPE %s %s\n", s.metric.name, s.metric.kind)
+		}
+		fmt.Fprintf(out, "%s%s %s\n", s.metric.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	if e.self != nil {
+		e.self.writePrometheus(out, now)
+	}
+	out.Flush()
+}
+
+// Serve runs an HTTP server for e until ctx is cancelled.
+func (e *PrometheusExporter) Serve(ctx context.Context, config *PrometheusConfig) error {
+	path := config.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, e)
+
+	server := &http.Server{
+		Addr:              config.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.WithFields(log.Fields{
+		"address": config.Address,
+		"path":    path,
+	}).Info("serving prometheus metrics")
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
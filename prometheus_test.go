@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	exporter := NewPrometheusExporter(&PrometheusConfig{StaleAfter: Duration(time.Minute)}, nil)
+	exporter.now = func() time.Time { return now }
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := io.ReadAll(recorder.Body)
+		return string(body)
+	}
+
+	exporter.Write("voltage", map[string]string{"serial": "01000123"}, map[string]interface{}{"volts": 120.5}, now)
+	exporter.Write("energy", map[string]string{"serial": "01000123", "channel": "2"}, map[string]interface{}{
+		"watts":      float64(100),
+		"watt-hours": 1234.5,
+		"amps":       0.8,
+	}, now)
+	exporter.Write("pulses", map[string]string{"serial": "01000123", "channel": "1", "room": `a "b"`}, map[string]interface{}{"pulses": int64(7)}, now)
+	exporter.Write("packet_stats", map[string]string{"serial": "01000123"}, map[string]interface{}{"packets": uint64(1)}, now)
+
+	want := `# HELP gem_channel_amps Current on the channel.
+# TYPE gem_channel_amps gauge
+gem_channel_amps{channel="2",serial="01000123"} 0.8
+# HELP gem_channel_watt_hours_total Energy used on the channel.
+# TYPE gem_channel_watt_hours_total counter
+gem_channel_watt_hours_total{channel="2",serial="01000123"} 1234.5
+# HELP gem_channel_watts Power on the channel.
+# TYPE gem_channel_watts gauge
+gem_channel_watts{channel="2",serial="01000123"} 100
+# HELP gem_pulses_total Pulses counted on the channel.
+# TYPE gem_pulses_total counter
+gem_pulses_total{channel="1",room="a \"b\"",serial="01000123"} 7
+# HELP gem_volts Line voltage measured by the device.
+# TYPE gem_volts gauge
+gem_volts{serial="01000123"} 120.5
+`
+	if got := scrape(); got != want {
+		t.Errorf("scrape =\n%s\nwant\n%s", got, want)
+	}
+
+	now = now.Add(45 * time.Second)
+	exporter.Write("voltage", map[string]string{"serial": "01000123"}, map[string]interface{}{"volts": 121.0}, now)
+	now = now.Add(30 * time.Second)
+
+	want = `# HELP gem_volts Line voltage measured by the device.
+# TYPE gem_volts gauge
+gem_volts{serial="01000123"} 121
+`
+	if got := scrape(); got != want {
+		t.Errorf("scrape after expiry =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configPollInterval is how often the configuration file is checked for
+// changes. Kubernetes updates a mounted ConfigMap by swapping a symlink
+// to a new directory, so the file's contents are compared rather than
+// watching it for writes.
+const configPollInterval = 5 * time.Second
+
+// collectorSet runs a Collector for each configured host, keyed by its
+// name, while Run is running, and starts and stops them as the
+// configuration changes.
+type collectorSet struct {
+	writer PointWriter
+
+	mu      sync.Mutex
+	hosts   []*HostConfig
+	ctx     context.Context
+	running map[string]*runningCollector
+}
+
+type runningCollector struct {
+	host      *HostConfig
+	collector *Collector
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func newCollectorSet(writer PointWriter) *collectorSet {
+	return &collectorSet{
+		writer:  writer,
+		running: make(map[string]*runningCollector),
+	}
+}
+
+// update sets the hosts to collect from, starting collectors for new
+// hosts, stopping those for removed hosts and restarting those whose
+// configuration changed if Run is running. Collectors for hosts that are
+// unchanged keep their connections. It returns once the collectors it
+// stopped have.
+func (s *collectorSet) update(hosts []*HostConfig) {
+	s.mu.Lock()
+	s.hosts = hosts
+	stopped := s.syncLocked()
+	s.mu.Unlock()
+	waitStopped(stopped)
+}
+
+// Run collects from the configured hosts until ctx is cancelled, and
+// returns once every collector has stopped.
+func (s *collectorSet) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.ctx = ctx
+	stopped := s.syncLocked()
+	s.mu.Unlock()
+	waitStopped(stopped)
+
+	<-ctx.Done()
+
+	s.mu.Lock()
+	s.ctx = nil
+	stopped = s.syncLocked()
+	s.mu.Unlock()
+	waitStopped(stopped)
+}
+
+// syncLocked makes the running collectors match the configured hosts, or
+// stops them all when Run is not running. It returns the done channels of
+// the collectors it stopped, to be waited on once s.mu is released so that
+// a collector slow to disconnect does not hold up Collectors. A collector
+// being replaced has still disconnected before its replacement dials, as
+// devices may only accept one connection.
+func (s *collectorSet) syncLocked() []chan struct{} {
+	wanted := make(map[string]*HostConfig)
+	if s.ctx != nil {
+		for _, host := range s.hosts {
+			wanted[host.Name()] = host
+		}
+	}
+
+	var stopped []chan struct{}
+	previous := make(map[string]chan struct{})
+	for name, running := range s.running {
+		host, ok := wanted[name]
+		if ok && reflect.DeepEqual(host, running.host) {
+			continue
+		}
+		running.cancel()
+		stopped = append(stopped, running.done)
+		previous[name] = running.done
+		delete(s.running, name)
+		log.WithFields(log.Fields{
+			"gemHost": name,
+		}).Info("stopped collector")
+	}
+
+	for name, host := range wanted {
+		if _, ok := s.running[name]; ok {
+			continue
+		}
+		collectorCtx, cancel := context.WithCancel(s.ctx)
+		running := &runningCollector{
+			host:      host,
+			collector: NewCollector(host, s.writer),
+			cancel:    cancel,
+			done:      make(chan struct{}),
+		}
+		s.running[name] = running
+
+		// done is only closed once the collector being replaced, if any,
+		// has stopped too, so that this holds however often it changes
+		replaced := previous[name]
+		go func() {
+			defer close(running.done)
+			if replaced != nil {
+				<-replaced
+				if collectorCtx.Err() != nil {
+					return
+				}
+			}
+			running.collector.Run(collectorCtx)
+		}()
+	}
+	return stopped
+}
+
+// waitStopped waits for every channel in done to be closed.
+func waitStopped(done []chan struct{}) {
+	for _, d := range done {
+		<-d
+	}
+}
+
+// Collectors returns the running collectors, ordered by host.
+func (s *collectorSet) Collectors() []*Collector {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.running))
+	for name := range s.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]*Collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, s.running[name].collector)
+	}
+	return collectors
+}
+
+// prepareConfig parses and validates a configuration, applying the
+// command line overrides, and compiles its virtual channels.
+func prepareConfig(data []byte, options *options) (*Config, map[string]*virtualChannel, error) {
+	config, err := parseConfig(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	options.apply(config)
+	err = config.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	virtual, err := compileVirtualChannels(config.VirtualChannels, config.Devices)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, virtual, nil
+}
+
+// reloader applies changes to the configuration file while running. Hosts,
+// device metadata and virtual channels take effect immediately; changes
+// to anything else are logged as needing a restart. A configuration that
+// is invalid is rejected and the running one kept.
+type reloader struct {
+	path       string
+	options    *options
+	collectors *collectorSet
+
+	// config is the running configuration, read from data
+	config *Config
+	data   []byte
+	// rejected is the last file found invalid, so that it is only
+	// reported once
+	rejected []byte
+}
+
+// Run checks for changes every configPollInterval, and reloads whenever
+// a value is received on hup, until ctx is cancelled.
+func (r *reloader) Run(ctx context.Context, hup <-chan os.Signal) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.WithFields(log.Fields{
+				"config": r.path,
+			}).Info("received SIGHUP, reloading configuration")
+			r.reload(true)
+		case <-ticker.C:
+			r.reload(false)
+		}
+	}
+}
+
+// reload reads the configuration file and applies it if it changed, or
+// regardless when force is set.
+func (r *reloader) reload(force bool) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"config": r.path,
+		}).Error("unable to read configuration file")
+		return
+	}
+	if !force && (bytes.Equal(data, r.data) || bytes.Equal(data, r.rejected)) {
+		return
+	}
+
+	config, virtual, err := prepareConfig(data, r.options)
+	if err != nil {
+		r.rejected = data
+		log.WithFields(log.Fields{
+			"error":  err,
+			"config": r.path,
+		}).Error("invalid configuration file, keeping the running configuration")
+		return
+	}
+
+	for name, changed := range map[string]bool{
+		"influxdb":         !reflect.DeepEqual(config.InfluxDB, r.config.InfluxDB),
+		"spool":            !reflect.DeepEqual(config.Spool, r.config.Spool),
+		"listen":           !reflect.DeepEqual(config.Listen, r.config.Listen),
+		"http":             !reflect.DeepEqual(config.HTTP, r.config.HTTP),
+		"prometheus":       !reflect.DeepEqual(config.Prometheus, r.config.Prometheus),
+		"mqtt":             !reflect.DeepEqual(config.MQTT, r.config.MQTT),
+		"self_metrics":     !reflect.DeepEqual(config.SelfMetrics, r.config.SelfMetrics),
+		"health":           !reflect.DeepEqual(config.Health, r.config.Health),
+		"leader_election":  !reflect.DeepEqual(config.LeaderElection, r.config.LeaderElection),
+		"shutdown_timeout": config.ShutdownTimeout != r.config.ShutdownTimeout,
+	} {
+		if changed {
+			log.WithFields(log.Fields{
+				"config":  r.path,
+				"section": name,
+			}).Warn("configuration changed that only takes effect on restart")
+		}
+	}
+
+	packetConfigs.set(config.Devices, virtual)
+	r.collectors.update(config.Hosts)
+	r.config = config
+	r.data = data
+	r.rejected = nil
+
+	log.WithFields(log.Fields{
+		"config": r.path,
+		"hosts":  len(config.Hosts),
+	}).Info("configuration reloaded")
+}
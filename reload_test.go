@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDevice accepts connections as a device would, without sending
+// anything.
+type testDevice struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newTestDevice(t *testing.T) *testDevice {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	device := &testDevice{listener: listener, conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			device.conns <- conn
+		}
+	}()
+	return device
+}
+
+func (d *testDevice) address() string {
+	return d.listener.Addr().String()
+}
+
+func (d *testDevice) accept(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-d.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no connection to %s", d.address())
+		return nil
+	}
+}
+
+func (d *testDevice) idle(t *testing.T) {
+	t.Helper()
+	select {
+	case <-d.conns:
+		t.Errorf("unexpected connection to %s", d.address())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// closed reports whether the collector's end of conn was closed, reading
+// past any polls it wrote.
+func closed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	return !os.IsTimeout(err)
+}
+
+func TestReload(t *testing.T) {
+	a, b := newTestDevice(t), newTestDevice(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	write := func(data string) {
+		err := os.WriteFile(path, []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("hosts: [" + a.address() + "]\ninfluxdb: http://127.0.0.1:1\n")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := prepareConfig(data, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	collectors := newCollectorSet(&recordingWriter{})
+	collectors.update(config.Hosts)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		collectors.Run(ctx)
+	}()
+	defer func() {
+		<-stopped
+	}()
+	defer cancel()
+	defer packetConfigs.set(nil, nil)
+	connA := a.accept(t)
+	r := &reloader{path: path, options: &options{}, collectors: collectors, config: config, data: data}
+
+	r.reload(false)
+	a.idle(t)
+
+	write("hosts: [" + a.address() + ", " + b.address() + "]\ninfluxdb: http://127.0.0.1:1\n" +
+		"devices:\n  '01000123':\n    channels:\n      1: {name: oven}\n")
+	r.reload(false)
+	connB := b.accept(t)
+	a.idle(t)
+	if channel := packetConfigs.get().device("01000123").channel("energy", 1); channel == nil || channel.Name != "oven" {
+		t.Errorf("channel 1 = %+v, want oven", channel)
+	}
+	if got := len(collectors.Collectors()); got != 2 {
+		t.Errorf("%d collectors, want 2", got)
+	}
+
+	applied := r.data
+	write("hosts: [" + b.address() + "]\ninfluxdb: http://127.0.0.1:1\nunknown: true\n")
+	r.reload(false)
+	if !bytes.Equal(r.data, applied) || r.config.Devices["01000123"] == nil {
+		t.Errorf("running configuration = %q, want the last valid one", r.data)
+	}
+	if got := len(collectors.Collectors()); got != 2 {
+		t.Errorf("%d collectors after an invalid configuration, want 2", got)
+	}
+	if packetConfigs.get().device("01000123") == nil {
+		t.Error("device metadata was replaced by an invalid configuration")
+	}
+
+	write("hosts: [{address: '" + b.address() + "', format: binary}]\ninfluxdb: http://127.0.0.1:1\n")
+	r.reload(false)
+	if !closed(connA) {
+		t.Errorf("connection to removed host %s is still open", a.address())
+	}
+	if !closed(connB) {
+		t.Errorf("connection to changed host %s is still open", b.address())
+	}
+	b.accept(t)
+	if packetConfigs.get().device("01000123") != nil {
+		t.Error("device metadata was not removed")
+	}
+	running := collectors.Collectors()
+	if len(running) != 1 || running[0].Status().Host != b.address() {
+		t.Errorf("collectors = %v, want %s", running, b.address())
+	}
+}
+
+// blockingWriter blocks every Write until release is closed.
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) error {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return nil
+}
+
+func TestCollectorSetStopping(t *testing.T) {
+	device := newTestDevice(t)
+	writer := &blockingWriter{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	collectors := newCollectorSet(writer)
+	collectors.update([]*HostConfig{{Address: device.address(), Format: "ascii"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		collectors.Run(ctx)
+	}()
+	defer func() {
+		<-stopped
+	}()
+	defer cancel()
+	var release sync.Once
+	unblock := func() {
+		release.Do(func() { close(writer.release) })
+	}
+	defer unblock()
+
+	conn := device.accept(t)
+	if _, err := conn.Write([]byte("n=01000123&v=120.5&p_1=100\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-writer.writing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no point written")
+	}
+
+	// the collector can not stop while its write is blocked
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		collectors.update(nil)
+	}()
+	removed := make(chan struct{})
+	go func() {
+		defer close(removed)
+		for len(collectors.Collectors()) != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Collectors() blocked by a collector stopping")
+	}
+	select {
+	case <-updated:
+		t.Error("update() returned before the collector stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unblock()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update() did not return once the collector stopped")
+	}
+}
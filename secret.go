@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Secret is a configuration value that is either given inline as a string
+// or read from a file or environment variable, as {"file": "/path"} or
+// {"env": "NAME"}.
+type Secret struct {
+	Value string
+	File  string
+	Env   string
+}
+
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*s = Secret{Value: value}
+		return nil
+	}
+
+	var source struct {
+		File string `json:"file"`
+		Env  string `json:"env"`
+	}
+	err := json.Unmarshal(data, &source)
+	if err != nil {
+		return err
+	}
+	if source.File != "" && source.Env != "" {
+		return fmt.Errorf("secret can not be read from both a file and the environment")
+	}
+	*s = Secret{File: source.File, Env: source.Env}
+	return nil
+}
+
+// Resolve returns the secret's value, reading it from its file or
+// environment variable if needed. Trailing newlines are trimmed from
+// files.
+func (s Secret) Resolve() (string, error) {
+	switch {
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("reading secret: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return value, nil
+	}
+	return s.Value, nil
+}
+
+// IsZero reports whether the secret is unset.
+func (s Secret) IsZero() bool {
+	return s == Secret{}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecret(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "password")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BRUL2INFLUX_TEST_SECRET", "from-env")
+
+	tests := []struct {
+		json    string
+		want    string
+		wantErr bool
+	}{
+		{json: `"inline"`, want: "inline"},
+		{json: `{"file": "` + path + `"}`, want: "from-file"},
+		{json: `{"env": "BRUL2INFLUX_TEST_SECRET"}`, want: "from-env"},
+		{json: `{"env": "BRUL2INFLUX_TEST_UNSET"}`, wantErr: true},
+		{json: `{"file": "` + filepath.Join(dir, "missing") + `"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var secret Secret
+		if err := json.Unmarshal([]byte(tt.json), &secret); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", tt.json, err)
+		}
+		got, err := secret.Resolve()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Resolve(%s) = %q, %v, want %q", tt.json, got, err, tt.want)
+		}
+	}
+
+	var secret Secret
+	if err := json.Unmarshal([]byte(`{"file": "a", "env": "B"}`), &secret); err == nil {
+		t.Error("secret with both file and env accepted")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+)
+
+const defaultBaud = 19200
+
+// SerialConfig describes a device attached to a local serial port.
+type SerialConfig struct {
+	Device string `json:"device"`
+	// Baud defaults to 19200, the factory setting of the GEM and ECM
+	// serial ports.
+	Baud int `json:"baud"`
+	// DataBits defaults to 8.
+	DataBits int `json:"data_bits"`
+	// Parity is one of "none" (the default), "even" or "odd".
+	Parity string `json:"parity"`
+	// StopBits is 1 (the default) or 2.
+	StopBits int `json:"stop_bits"`
+}
+
+func (s *SerialConfig) baud() int {
+	if s.Baud == 0 {
+		return defaultBaud
+	}
+	return s.Baud
+}
+
+func (s *SerialConfig) dataBits() int {
+	if s.DataBits == 0 {
+		return 8
+	}
+	return s.DataBits
+}
+
+func (s *SerialConfig) stopBits() int {
+	if s.StopBits == 0 {
+		return 1
+	}
+	return s.StopBits
+}
+
+func (s *SerialConfig) Validate() error {
+	if s.Device == "" {
+		return fmt.Errorf("serial port without device")
+	}
+	if _, ok := baudRates[s.baud()]; !ok {
+		return fmt.Errorf("unsupported baud rate %d", s.baud())
+	}
+	if bits := s.dataBits(); bits < 5 || bits > 8 {
+		return fmt.Errorf("unsupported data bits %d", bits)
+	}
+	switch s.Parity {
+	case "", "none", "even", "odd":
+	default:
+		return fmt.Errorf("unknown parity %q", s.Parity)
+	}
+	if bits := s.stopBits(); bits != 1 && bits != 2 {
+		return fmt.Errorf("unsupported stop bits %d", bits)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	1200:   unix.B1200,
+	2400:   unix.B2400,
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+	921600: unix.B921600,
+}
+
+var dataBitFlags = map[int]uint32{
+	5: unix.CS5,
+	6: unix.CS6,
+	7: unix.CS7,
+	8: unix.CS8,
+}
+
+// openSerial opens and configures a serial port in raw mode. The port is
+// opened non-blocking so that read deadlines work on the returned file.
+func openSerial(config *SerialConfig) (*os.File, error) {
+	f, err := os.OpenFile(config.Device, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// f.Fd() would switch the file back to blocking mode, so configure it
+	// through the raw connection instead
+	raw, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var termiosErr error
+	err = raw.Control(func(fd uintptr) {
+		termiosErr = configureSerial(int(fd), config)
+	})
+	if err == nil {
+		err = termiosErr
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("configuring %s: %w", config.Device, err)
+	}
+
+	return f, nil
+}
+
+func configureSerial(fd int, config *SerialConfig) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+
+	speed := baudRates[config.baud()]
+
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CBAUD | unix.CRTSCTS
+	t.Cflag |= dataBitFlags[config.dataBits()] | unix.CREAD | unix.CLOCAL | speed
+	switch config.Parity {
+	case "even":
+		t.Cflag |= unix.PARENB
+	case "odd":
+		t.Cflag |= unix.PARENB | unix.PARODD
+	}
+	if config.stopBits() == 2 {
+		t.Cflag |= unix.CSTOPB
+	}
+	t.Ispeed = speed
+	t.Ospeed = speed
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
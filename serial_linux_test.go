@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master side of a new pseudo-terminal and the path of
+// its slave side.
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminal support: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatalf("unlocking pty: %v", err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatalf("getting pty number: %v", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestOpenSerialConfiguresPort(t *testing.T) {
+	_, slave := openPTY(t)
+
+	// data bits and parity are not checked as the pty driver forces 8N
+	port, err := openSerial(&SerialConfig{Device: slave, Baud: 9600, DataBits: 7, Parity: "even", StopBits: 2})
+	if err != nil {
+		t.Fatalf("openSerial() error = %v", err)
+	}
+	defer port.Close()
+
+	raw, err := port.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var termios *unix.Termios
+	raw.Control(func(fd uintptr) {
+		termios, err = unix.IoctlGetTermios(int(fd), unix.TCGETS)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := termios.Cflag & unix.CBAUD; got != unix.B9600 {
+		t.Errorf("baud flags = %#o, want %#o", got, unix.B9600)
+	}
+	if termios.Cflag&unix.CSTOPB == 0 {
+		t.Error("two stop bits not set")
+	}
+	if termios.Lflag&unix.ICANON != 0 {
+		t.Error("port is not in raw mode")
+	}
+
+	// the port must stay pollable for inactivity timeouts to work
+	if err := port.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Errorf("SetReadDeadline() error = %v", err)
+	}
+}
+
+func TestCollectorSerial(t *testing.T) {
+	master, slave := openPTY(t)
+
+	writer := &recordingWriter{}
+	collector := NewCollector(&HostConfig{
+		Serial: &SerialConfig{Device: slave},
+	}, writer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		collector.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// answer the first poll with a packet, as a GEM would
+	polls := bufio.NewReader(master)
+	poll := make([]byte, len("^^^APISPK"))
+	if _, err := polls.Read(poll); err != nil {
+		t.Fatalf("reading poll: %v", err)
+	}
+	if string(poll) != "^^^APISPK" {
+		t.Errorf("poll = %q, want %q", poll, "^^^APISPK")
+	}
+	if _, err := master.Write([]byte("n=01000123&v=120.5&p_1=100\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		point, ok := writer.find("voltage")
+		if ok {
+			if point.tags["serial"] != "01000123" || point.fields["volts"] != 120.5 {
+				t.Errorf("voltage point = %+v", point)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no voltage point written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := collector.Status(); status.State != StateConnected || status.Host != slave {
+		t.Errorf("status = %+v", status)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+	log "github.com/sirupsen/logrus"
+)
+
+// virtualMaxAge is how old the latest reading of a referenced channel may
+// be for a virtual channel to be evaluated.
+const virtualMaxAge = time.Minute
+
+// VirtualChannelConfig defines an energy channel computed from others, such
+// as "01000123:1 + 01000123:2 - 01000456:5". References are
+// serial:channel, for a device listed in devices, or the name of another
+// virtual channel, and may be combined with numbers, + - * / and
+// parentheses. Watts, amps and watt-hours are each computed with the
+// expression.
+type VirtualChannelConfig struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	// Serial is the serial tag written, "virtual" by default.
+	Serial string `json:"serial"`
+}
+
+func (v *VirtualChannelConfig) serial() string {
+	if v.Serial == "" {
+		return "virtual"
+	}
+	return v.Serial
+}
+
+// channelKey identifies an energy channel of a device.
+type channelKey struct {
+	serial  string
+	channel int64
+}
+
+func (k channelKey) String() string {
+	return fmt.Sprintf("%s:%d", k.serial, k.channel)
+}
+
+// expression is a parsed virtual channel expression.
+type expression interface {
+	// eval computes the expression, looking references up with value. It
+	// returns false if a reference has no value.
+	eval(value func(ref *reference) (float64, bool)) (float64, bool)
+	// references calls fn for each reference in the expression.
+	references(fn func(ref *reference))
+}
+
+type number float64
+
+func (n number) eval(func(*reference) (float64, bool)) (float64, bool) {
+	return float64(n), true
+}
+
+func (n number) references(func(*reference)) {}
+
+// reference is either a device channel or, when virtual is set, another
+// virtual channel.
+type reference struct {
+	channel channelKey
+	virtual string
+}
+
+func (r *reference) eval(value func(*reference) (float64, bool)) (float64, bool) {
+	return value(r)
+}
+
+func (r *reference) references(fn func(*reference)) {
+	fn(r)
+}
+
+type negate struct{ x expression }
+
+func (n negate) eval(value func(*reference) (float64, bool)) (float64, bool) {
+	x, ok := n.x.eval(value)
+	return -x, ok
+}
+
+func (n negate) references(fn func(*reference)) {
+	n.x.references(fn)
+}
+
+type binary struct {
+	op          byte
+	left, right expression
+}
+
+func (b binary) eval(value func(*reference) (float64, bool)) (float64, bool) {
+	left, ok := b.left.eval(value)
+	if !ok {
+		return 0, false
+	}
+	right, ok := b.right.eval(value)
+	if !ok {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	default:
+		return left / right, true
+	}
+}
+
+func (b binary) references(fn func(*reference)) {
+	b.left.references(fn)
+	b.right.references(fn)
+}
+
+// expressionParser is a recursive descent parser for expressions.
+type expressionParser struct {
+	input string
+	pos   int
+}
+
+func parseExpression(input string) (expression, error) {
+	p := &expressionParser{input: input}
+	expr, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.input[p.pos], p.pos)
+	}
+	return expr, nil
+}
+
+func (p *expressionParser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *expressionParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *expressionParser) sum() (expression, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *expressionParser) product() (expression, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *expressionParser) unary() (expression, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negate{x}, nil
+	case '(':
+		p.pos++
+		x, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+	}
+	return p.operand()
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '.' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// operand parses a number, a serial:channel reference or the name of a
+// virtual channel.
+func (p *expressionParser) operand() (expression, error) {
+	start := p.pos
+	for p.pos < len(p.input) && isNameByte(p.input[p.pos]) {
+		p.pos++
+	}
+	token := p.input[start:p.pos]
+	if token == "" {
+		if p.pos >= len(p.input) {
+			return nil, fmt.Errorf("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.input[p.pos], p.pos)
+	}
+
+	if serial, channel, ok := strings.Cut(token, ":"); ok {
+		n, err := strconv.ParseInt(channel, 10, 64)
+		if err != nil || serial == "" || n < 1 {
+			return nil, fmt.Errorf("invalid reference %q, want serial:channel", token)
+		}
+		return &reference{channel: channelKey{serial: serial, channel: n}}, nil
+	}
+	if c := token[0]; c >= '0' && c <= '9' || c == '.' {
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+		return number(value), nil
+	}
+	if strings.Contains(token, ".") {
+		return nil, fmt.Errorf("invalid name %q", token)
+	}
+	return &reference{virtual: token}, nil
+}
+
+func validVirtualName(name string) bool {
+	for i, c := range []byte(name) {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// virtualChannel is a compiled VirtualChannelConfig.
+type virtualChannel struct {
+	config *VirtualChannelConfig
+	expr   expression
+	// primary is the first device the channel depends on; the channel is
+	// evaluated whenever a packet from it is written
+	primary string
+}
+
+// compileVirtualChannels parses and checks virtual channel definitions.
+// References to unknown virtual channels, to devices that are not listed
+// in devices or to channels disabled there, and cycles are errors.
+func compileVirtualChannels(configs []*VirtualChannelConfig, devices map[string]*DeviceConfig) (map[string]*virtualChannel, error) {
+	channels := make(map[string]*virtualChannel)
+	var order []string
+	for i, config := range configs {
+		if config == nil || config.Name == "" {
+			return nil, &pathError{fmt.Sprintf("[%d]", i), fmt.Errorf("virtual channel without a name")}
+		}
+		if !validVirtualName(config.Name) {
+			return nil, &pathError{fmt.Sprintf("[%d].name", i), fmt.Errorf("virtual channel %q: name must be a letter followed by letters, digits or _", config.Name)}
+		}
+		if _, ok := channels[config.Name]; ok {
+			return nil, &pathError{fmt.Sprintf("[%d].name", i), fmt.Errorf("virtual channel %s: defined twice", config.Name)}
+		}
+		expr, err := parseExpression(config.Expression)
+		if err != nil {
+			return nil, &pathError{fmt.Sprintf("[%d].expression", i), fmt.Errorf("virtual channel %s: %w", config.Name, err)}
+		}
+		channels[config.Name] = &virtualChannel{config: config, expr: expr}
+		order = append(order, config.Name)
+	}
+
+	// order matches configs, as any error above returned early
+	for i, name := range order {
+		var err error
+		channels[name].expr.references(func(ref *reference) {
+			if err != nil {
+				return
+			}
+			if ref.virtual != "" {
+				if _, ok := channels[ref.virtual]; !ok {
+					err = fmt.Errorf("virtual channel %s: unknown reference %s", name, ref.virtual)
+				}
+				return
+			}
+			device, ok := devices[ref.channel.serial]
+			if !ok {
+				err = fmt.Errorf("virtual channel %s: %s: device %s is not listed in devices", name, ref.channel, ref.channel.serial)
+				return
+			}
+			if channel := device.channel("energy", ref.channel.channel); channel != nil && channel.Disabled {
+				err = fmt.Errorf("virtual channel %s: %s is disabled", name, ref.channel)
+			}
+		})
+		if err != nil {
+			return nil, &pathError{fmt.Sprintf("[%d].expression", i), err}
+		}
+	}
+
+	// depth first search for cycles, which also finds each channel's
+	// primary device
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("virtual channels form a cycle: %s", strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		channel := channels[name]
+		var err error
+		channel.expr.references(func(ref *reference) {
+			if err != nil {
+				return
+			}
+			if ref.virtual == "" {
+				if channel.primary == "" {
+					channel.primary = ref.channel.serial
+				}
+				return
+			}
+			err = visit(ref.virtual, append(path, name))
+			if err == nil && channel.primary == "" {
+				channel.primary = channels[ref.virtual].primary
+			}
+		})
+		state[name] = visited
+		return err
+	}
+	for i, name := range order {
+		err := visit(name, nil)
+		if err != nil {
+			return nil, &pathError{fmt.Sprintf("[%d]", i), err}
+		}
+		if channels[name].primary == "" {
+			return nil, &pathError{fmt.Sprintf("[%d].expression", i), fmt.Errorf("virtual channel %s: does not reference any device channel", name)}
+		}
+	}
+	return channels, nil
+}
+
+// energyReading is the latest corrected reading of a channel.
+type energyReading struct {
+	sample gem.EnergySample
+	ts     time.Time
+}
+
+// virtualRegistry evaluates virtual channels from the latest reading of
+// each device channel.
+type virtualRegistry struct {
+	mu       sync.Mutex
+	channels map[string]*virtualChannel
+	readings map[channelKey]energyReading
+}
+
+func newVirtualRegistry() *virtualRegistry {
+	return &virtualRegistry{
+		readings: make(map[channelKey]energyReading),
+	}
+}
+
+// set replaces the virtual channels, forgetting the readings recorded for
+// the previous ones.
+func (r *virtualRegistry) set(channels map[string]*virtualChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channels = channels
+	r.readings = make(map[channelKey]energyReading)
+}
+
+// record stores the reading of an energy channel as it was written.
+func (r *virtualRegistry) record(serial string, channel int64, sample gem.EnergySample, ts time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.channels) == 0 {
+		return
+	}
+	r.readings[channelKey{serial: serial, channel: channel}] = energyReading{sample: sample, ts: ts}
+}
+
+// evaluate writes the virtual channels whose primary device is serial,
+// for a packet timestamped ts.
+func (r *virtualRegistry) evaluate(ibgw PointWriter, serial string, ts time.Time) {
+	type result struct {
+		channel *virtualChannel
+		fields  map[string]interface{}
+	}
+	var results []result
+
+	r.mu.Lock()
+	for _, channel := range r.channels {
+		if channel.primary != serial {
+			continue
+		}
+		fields := map[string]interface{}{}
+		for field, get := range map[string]func(gem.EnergySample) float64{
+			"watts":      func(s gem.EnergySample) float64 { return s.Watts },
+			"amps":       func(s gem.EnergySample) float64 { return s.Amps },
+			"watt-hours": func(s gem.EnergySample) float64 { return s.WattHours },
+		} {
+			value, ok := r.evalLocked(channel, get, ts)
+			if !ok {
+				break
+			}
+			fields[field] = value
+		}
+		if len(fields) != 3 {
+			log.WithFields(log.Fields{
+				"virtual-channel": channel.config.Name,
+				"serial":          serial,
+			}).Debug("skipping virtual channel without current readings for every reference")
+			continue
+		}
+		results = append(results, result{channel: channel, fields: fields})
+	}
+	r.mu.Unlock()
+
+	for _, result := range results {
+		tags := map[string]string{
+			"serial":  result.channel.config.serial(),
+			"channel": result.channel.config.Name,
+			"virtual": "true",
+		}
+		err := ibgw.Write("energy", tags, result.fields, ts)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"tags":   tags,
+				"fields": result.fields,
+			}).Error("unable to create point for virtual energy")
+		}
+	}
+}
+
+// evalLocked computes one field of channel from readings no older than
+// virtualMaxAge relative to ts.
+func (r *virtualRegistry) evalLocked(channel *virtualChannel, get func(gem.EnergySample) float64, ts time.Time) (float64, bool) {
+	var value func(ref *reference) (float64, bool)
+	value = func(ref *reference) (float64, bool) {
+		if ref.virtual != "" {
+			return r.channels[ref.virtual].expr.eval(value)
+		}
+		reading, ok := r.readings[ref.channel]
+		if !ok {
+			return 0, false
+		}
+		if age := ts.Sub(reading.ts); age > virtualMaxAge || age < -virtualMaxAge {
+			return 0, false
+		}
+		return get(reading.sample), true
+	}
+	result, ok := channel.expr.eval(value)
+	if !ok || math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, false
+	}
+	return result, true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamjacobmuller/brul2influx/gem"
+)
+
+func TestCompileVirtualChannels(t *testing.T) {
+	devices := map[string]*DeviceConfig{
+		"01000123": {Channels: map[int64]*ChannelConfig{3: {Disabled: true}}},
+		"01000456": {},
+	}
+	tests := []struct {
+		name     string
+		channels []*VirtualChannelConfig
+		wantErr  string
+	}{
+		{
+			name: "valid",
+			channels: []*VirtualChannelConfig{
+				{Name: "house", Expression: "01000123:1 + 01000123:2 - 01000456:5"},
+				{Name: "unmonitored", Expression: "house - (01000123:1 * 0.5) / 2"},
+			},
+		},
+		{name: "syntax", channels: []*VirtualChannelConfig{{Name: "a", Expression: "01000123:1 +"}}, wantErr: "unexpected end"},
+		{name: "bad reference", channels: []*VirtualChannelConfig{{Name: "a", Expression: "01000123:x"}}, wantErr: "invalid reference"},
+		{name: "unknown reference", channels: []*VirtualChannelConfig{{Name: "a", Expression: "01000123:1 + solar"}}, wantErr: "unknown reference solar"},
+		{name: "unknown device", channels: []*VirtualChannelConfig{{Name: "a", Expression: "01000123:1 + 01000789:2"}}, wantErr: "device 01000789 is not listed"},
+		{name: "disabled reference", channels: []*VirtualChannelConfig{{Name: "a", Expression: "01000123:3"}}, wantErr: "01000123:3 is disabled"},
+		{name: "constant", channels: []*VirtualChannelConfig{{Name: "a", Expression: "2 * 3"}}, wantErr: "does not reference"},
+		{name: "bad name", channels: []*VirtualChannelConfig{{Name: "1a", Expression: "01000123:1"}}, wantErr: "name must be"},
+		{
+			name: "cycle",
+			channels: []*VirtualChannelConfig{
+				{Name: "a", Expression: "01000123:1 + b"},
+				{Name: "b", Expression: "c"},
+				{Name: "c", Expression: "a"},
+			},
+			wantErr: "cycle: a -> b -> c -> a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileVirtualChannels(tt.channels, devices)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("compileVirtualChannels() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("compileVirtualChannels() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVirtualChannels(t *testing.T) {
+	devices := map[string]*DeviceConfig{"01000123": {}, "01000456": {}}
+	channels, err := compileVirtualChannels([]*VirtualChannelConfig{
+		{Name: "house", Expression: "01000123:1 + 01000123:2 - 01000456:5"},
+		{Name: "other", Expression: "house - 01000123:1", Serial: "home"},
+	}, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetConfigs.set(devices, channels)
+	defer packetConfigs.set(nil, nil)
+
+	write := func(data string, ts time.Time) *recordingWriter {
+		packet, err := gem.ParseASCII([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := &recordingWriter{}
+		writePacket(writer, &HostConfig{Address: "gem:8000"}, packet, ts)
+		return writer
+	}
+	virtual := func(writer *recordingWriter) map[string]recordedPoint {
+		points := map[string]recordedPoint{}
+		for _, point := range writer.points {
+			if point.tags["virtual"] == "true" {
+				points[point.tags["channel"]] = point
+			}
+		}
+		return points
+	}
+
+	now := time.Now()
+	if points := virtual(write("n=01000123&v=120&p_1=1000&p_2=500&a_1=8&a_2=4&wh_1=10&wh_2=5", now)); len(points) != 0 {
+		t.Errorf("wrote %v before every reference had a reading", points)
+	}
+	if points := virtual(write("n=01000456&v=120&p_5=300&a_5=2&wh_5=3", now)); len(points) != 0 {
+		t.Errorf("wrote %v for a packet from a device that is not primary", points)
+	}
+
+	points := virtual(write("n=01000123&v=120&p_1=1100&p_2=500&a_1=9&a_2=4&wh_1=11&wh_2=5", now.Add(10*time.Second)))
+	house := points["house"]
+	if house.measurement != "energy" || house.tags["serial"] != "virtual" {
+		t.Errorf("house = %+v", house)
+	}
+	if house.fields["watts"] != 1300.0 || house.fields["amps"] != 11.0 || house.fields["watt-hours"] != 13.0 {
+		t.Errorf("house fields = %v, want 1300 W, 11 A and 13 Wh", house.fields)
+	}
+	if other := points["other"]; other.tags["serial"] != "home" || other.fields["watts"] != 200.0 {
+		t.Errorf("other = %+v, want 200 W", other)
+	}
+
+	if points := virtual(write("n=01000123&v=120&p_1=1100&p_2=500", now.Add(2*time.Minute))); len(points) != 0 {
+		t.Errorf("wrote %v from a stale reading", points)
+	}
+	// replacing the channels forgets the readings recorded so far
+	packetConfigs.set(devices, channels)
+	if points := virtual(write("n=01000123&v=120&p_1=1100&p_2=500&a_1=9&a_2=4&wh_1=11&wh_2=5", now.Add(20*time.Second))); len(points) != 0 {
+		t.Errorf("wrote %v from a reading recorded before the channels were replaced", points)
+	}
+}